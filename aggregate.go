@@ -0,0 +1,161 @@
+package authalog
+
+import (
+	"context"
+	"fmt"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// aggregateFunctions are the functions that aggregate literals may apply to the answers of
+// the literal they range over:
+//
+//	count - the number of answers
+//	sum   - the sum of the aggregated term over the answers, which must all be numbers
+//	min   - the least value of the aggregated term, if there are any answers
+//	max   - the greatest value of the aggregated term, if there are any answers
+var aggregateFunctions = map[string]struct{}{
+	"count": {},
+	"sum":   {},
+	"min":   {},
+	"max":   {},
+}
+
+func (l Literal) isAggregate() bool {
+	return l.Aggregate != ""
+}
+
+// aggregated returns the literal whose answers an aggregate literal ranges over.
+func (l Literal) aggregated() Literal {
+	return Literal{
+		Predicate: l.Predicate,
+		Terms:     l.Terms[2:],
+	}
+}
+
+// aggregate applies the function of the aggregate literal l to answers, which must be every
+// answer to l.aggregated(). It returns false if there is no value, as for the min of no answers.
+func aggregate(in interner, l Literal, answers []Literal) (Term, bool, error) {
+	over := l.aggregated()
+	values := make([]Term, 0, len(answers))
+	for _, a := range answers {
+		env := emptyEnvironment()
+		if !unify(over, a, &env) {
+			return Term{}, false, fmt.Errorf("answer %v does not match aggregated literal %v", a, over)
+		}
+		values = append(values, env.chase(l.Terms[1]))
+	}
+
+	switch l.Aggregate {
+	case "count":
+		return intTerm(int64(len(values))), true, nil
+	case "sum":
+		sum := intTerm(0)
+		for _, v := range values {
+			if !v.isNumber() {
+				return Term{}, false, fmt.Errorf("cannot sum %v, which is not a number", constantString(in, v))
+			}
+			if sum.Kind == KindInt && v.Kind == KindInt {
+				sum = intTerm(sum.Value + v.Value)
+			} else {
+				sum = floatTerm(sum.float() + v.float())
+			}
+		}
+		return sum, true, nil
+	case "min", "max":
+		if len(values) == 0 {
+			return Term{}, false, nil
+		}
+		best := values[0]
+		for _, v := range values[1:] {
+			c, ordered := compareTerms(in, v, best)
+			if !ordered {
+				return Term{}, false, fmt.Errorf("cannot find the %v of %v and %v, which are not ordered", l.Aggregate, constantString(in, v), constantString(in, best))
+			}
+			if (l.Aggregate == "min" && c < 0) || (l.Aggregate == "max" && c > 0) {
+				best = v
+			}
+		}
+		return best, true, nil
+	}
+	return Term{}, false, fmt.Errorf("unknown aggregate function %v", l.Aggregate)
+}
+
+// aggregateEnvironment binds the result term of the aggregate literal l to value, returning
+// false if the result is a constant other than value.
+func aggregateEnvironment(l Literal, value Term) (environment, bool) {
+	env := emptyEnvironment()
+	result := l.Terms[0]
+	if result.IsConstant {
+		return env, result == value
+	}
+	env.bind(result.Value, value)
+	return env, true
+}
+
+// evaluateAggregate asks for every answer to the literal that l aggregates, and returns l's
+// result bound in an environment, or false if l does not hold.
+func (db *Database) evaluateAggregate(ctx context.Context, l Literal) (environment, bool, error) {
+	results, err := db.ask(ctx, l.aggregated())
+	if err != nil {
+		return environment{}, false, err
+	}
+	answers := make([]Literal, len(results))
+	for i, r := range results {
+		answers[i] = r.Literal
+	}
+	value, ok, err := aggregate(db, l, answers)
+	if err != nil || !ok {
+		return environment{}, false, err
+	}
+	env, ok := aggregateEnvironment(l, value)
+	return env, ok, nil
+}
+
+// visitAggregate evaluates the aggregate literal leading a chain, once every answer to the
+// literal it ranges over has been found.
+func (g *goal) visitAggregate(chainId uuid.UUID) error {
+	chain := g.chains[chainId]
+	l := chain.body[0]
+
+	id, isNew, err := g.putSubgoal(l.aggregated(), emptyEnvironment(), []dependent{})
+	if err != nil {
+		return err
+	}
+	if isNew {
+		err = g.visitSubgoal(id)
+		if err != nil {
+			return err
+		}
+	}
+	err = g.flushExternal()
+	if err != nil {
+		return err
+	}
+	// Stratification guarantees that the aggregated subgoal does not depend on any subgoal
+	// still being searched, so its results are complete.
+	sg := g.subgoals[id]
+	answers := make([]Literal, 0, len(sg.results))
+	for _, r := range sg.results {
+		answers = append(answers, r.Literal)
+	}
+	invalidators := map[uuid.UUID]Literal{sg.Literal.id(): sg.Literal}
+
+	value, ok, err := aggregate(g.db, l, answers)
+	if err != nil {
+		return fmt.Errorf("In %v, got error: %w", g.db.literalString(l), err)
+	}
+	if ok {
+		if env, ok := aggregateEnvironment(l, value); ok {
+			return g.mergeResultIntoChain(chain, result{
+				env:          env,
+				Literal:      env.rewrite(l),
+				invalidators: invalidators,
+			})
+		}
+	}
+	return g.mergeResultIntoChain(chain, result{
+		isFailure:    true,
+		invalidators: invalidators,
+	})
+}
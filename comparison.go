@@ -0,0 +1,85 @@
+package authalog
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// comparisonOperators maps each built in comparison to the infix operator that denotes it.
+var comparisonOperators = map[string]string{
+	"lt":  "<",
+	"le":  "<=",
+	"gt":  ">",
+	"ge":  ">=",
+	"neq": "!=",
+}
+
+// Builtin comparison relations. Each holds when its bound arguments compare as its operator
+// requires. Numbers compare numerically, whether integers or floats, and atoms compare by
+// their text. A number and an atom are never ordered, but are not equal.
+var comparisons = []ExternalRelation{
+	comparisonRelation("lt", func(c int) bool { return c < 0 }),
+	comparisonRelation("le", func(c int) bool { return c <= 0 }),
+	comparisonRelation("gt", func(c int) bool { return c > 0 }),
+	comparisonRelation("ge", func(c int) bool { return c >= 0 }),
+	comparisonRelation("neq", func(c int) bool { return c != 0 }),
+}
+
+func comparisonRelation(predicate string, holds func(c int) bool) ExternalRelation {
+	return ExternalRelation{
+		head: Literal{
+			Predicate: predicate,
+			Terms:     makeVars(2),
+		},
+		run: func(_ context.Context, intern interner, terms []Term) ([][]Term, error) {
+			if !terms[0].IsConstant || !terms[1].IsConstant {
+				return nil, fmt.Errorf("%v/2 can only be evaluated once both of its arguments are bound", predicate)
+			}
+			c, ordered := compareTerms(intern, terms[0], terms[1])
+			if !ordered {
+				if predicate == "neq" {
+					return [][]Term{terms}, nil
+				}
+				return [][]Term{}, nil
+			}
+			if holds(c) {
+				return [][]Term{terms}, nil
+			}
+			return [][]Term{}, nil
+		},
+	}
+}
+
+// compareTerms returns -1, 0 or 1 as a is less than, equal to or greater than b. It returns
+// false if a and b are a number and an atom, which are not ordered.
+func compareTerms(intern interner, a Term, b Term) (int, bool) {
+	switch {
+	case a.isNumber() && b.isNumber():
+		if a.Kind == KindInt && b.Kind == KindInt {
+			switch {
+			case a.Value < b.Value:
+				return -1, true
+			case a.Value > b.Value:
+				return 1, true
+			}
+			return 0, true
+		}
+		af, bf := a.float(), b.float()
+		switch {
+		case af < bf:
+			return -1, true
+		case af > bf:
+			return 1, true
+		}
+		return 0, true
+	case !a.isNumber() && !b.isNumber():
+		return strings.Compare(intern.lookup(a.Value), intern.lookup(b.Value)), true
+	}
+	return 0, false
+}
+
+func isComparison(l Literal) bool {
+	_, ok := comparisonOperators[l.Predicate]
+	return ok && len(l.Terms) == 2 && !l.isAggregate()
+}
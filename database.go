@@ -2,6 +2,7 @@ package authalog
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"sync"
 
@@ -13,8 +14,16 @@ type Database struct {
 	clauseMutex sync.RWMutex
 	// Map id to Clause
 	clauses map[uuid.UUID]Clause
-	// Unindexed external rules
-	externalRelations []ExternalRelation
+	// Index of clause heads, kept in step with clauses
+	index clauseIndex
+	// Map predicate and arity, as keyed in index, to the external relations providing them
+	externalRelations map[indexKey][]ExternalRelation
+	// Map head predicate to the predicates its rules' bodies depend on
+	dependencies map[string]map[string]*dependency
+	// Map predicate to arity to the number of clauses defining it
+	definitions map[string]map[int]int
+	// Reject clauses whose arities disagree with existing definitions
+	checkOnAssert bool
 
 	resultsMutex sync.RWMutex
 	// Map Literal id to proof
@@ -25,6 +34,8 @@ type Database struct {
 	results map[uuid.UUID][]result
 	// Map subgoal hash to other subgoal hashes that depend on it
 	invalidations map[uuid.UUID]*invalidation
+	// Map subgoal hash to the subgoal's literal, for every subgoal with cached results
+	cachedSubgoals map[uuid.UUID]Literal
 
 	internMutex sync.RWMutex
 	// Used to freshen all stored clauses, so that there are no name collisions between scopes
@@ -39,10 +50,14 @@ type Database struct {
 func NewDatabase() *Database {
 	d := Database{
 		clauses:           map[uuid.UUID]Clause{},
-		externalRelations: []ExternalRelation{},
+		index:             clauseIndex{},
+		externalRelations: map[indexKey][]ExternalRelation{},
+		dependencies:      map[string]map[string]*dependency{},
+		definitions:       map[string]map[int]int{},
 		invalidations:     map[uuid.UUID]*invalidation{},
 		proofs:            map[uuid.UUID][]proof{},
 		results:           map[uuid.UUID][]result{},
+		cachedSubgoals:    map[uuid.UUID]Literal{},
 		vars:              0,
 		interned:          map[string]int64{},
 		internedLookup:    map[int64]string{},
@@ -50,11 +65,38 @@ func NewDatabase() *Database {
 	}
 	// Builtin in/2 relation
 	d.AddExternalRelations(isIn)
+	// Builtin comparisons: lt/2, le/2, gt/2, ge/2 and neq/2
+	d.AddExternalRelations(comparisons...)
+	// Builtin arithmetic: add/3, sub/3, mul/3, div/3 and mod/3
+	d.AddExternalRelations(arithmetic...)
 	return &d
 }
 
+// AddExternalRelations adds relations that provide predicates from outside the database.
+//
+// Relations with modes should be added before the rules that call them are asserted, so that
+// rules that cannot call them are rejected by Assert. Rules already stored are reordered to
+// satisfy the modes of the relations they call, but those that no order can satisfy are only
+// reported by Check.
 func (db *Database) AddExternalRelations(er ...ExternalRelation) {
-	db.externalRelations = append(db.externalRelations, er...)
+	db.clauseMutex.Lock()
+	moded := map[indexKey]struct{}{}
+	for _, r := range er {
+		k := predicateKey(r.head)
+		db.externalRelations[k] = append(db.externalRelations[k], r)
+		if len(r.modes) > 0 {
+			moded[k] = struct{}{}
+		}
+	}
+	var rescheduled []Literal
+	if len(moded) > 0 {
+		rescheduled = db.rescheduleCalls(moded)
+	}
+	db.clauseMutex.Unlock()
+
+	for _, head := range rescheduled {
+		db.invalidateHead(head)
+	}
 }
 
 type proof struct {
@@ -64,6 +106,8 @@ type proof struct {
 	Clause  uuid.UUID
 	// Substitutions should map variable -> constant for all variables that appear in 'Clause'
 	substitutions environment
+	// External is set, and Clause is nil, when the literal was provided by an external relation
+	external *ExternalOrigin
 }
 
 type result struct {
@@ -89,11 +133,22 @@ func (c Clause) id() uuid.UUID {
 	binary.Write(hasher, binary.LittleEndian, c.Head.Terms)
 	for _, l := range c.Body {
 		hasher.Write([]byte(l.Predicate))
+		if l.Aggregate != "" {
+			hasher.Write([]byte("{" + l.Aggregate))
+		}
 		binary.Write(hasher, binary.LittleEndian, l.Terms)
 	}
 	return idFromInts(hasher.Sum128())
 }
 
+// Clause tag is a hash of the clause's structure. Two Clauses have the same tag if there
+// exists a variable renaming wherein they are identical.
+func (c Clause) tag() uuid.UUID {
+	hasher := murmur3.New128()
+	writeStructuralTag(hasher, append([]Literal{c.Head}, c.Body...))
+	return idFromInts(hasher.Sum128())
+}
+
 func hashIDs(ids []uuid.UUID) uuid.UUID {
 	hasher := murmur3.New128()
 	for _, v := range ids {
@@ -112,6 +167,9 @@ func (l Literal) id() uuid.UUID {
 		hasher.Write([]byte{0})
 	}
 	hasher.Write([]byte(l.Predicate))
+	if l.Aggregate != "" {
+		hasher.Write([]byte("{" + l.Aggregate))
+	}
 	ids := map[int64]int64{}
 	terms := make([]Term, len(l.Terms))
 	for i, v := range l.Terms {
@@ -142,6 +200,9 @@ func writeStructuralTag(hasher murmur3.Hash128, literals []Literal) {
 			hasher.Write([]byte{0})
 		}
 		hasher.Write([]byte(l.Predicate))
+		if l.Aggregate != "" {
+			hasher.Write([]byte("{" + l.Aggregate))
+		}
 		for i, v := range l.Terms {
 			if v.IsConstant {
 				terms[i] = v
@@ -159,24 +220,60 @@ func writeStructuralTag(hasher murmur3.Hash128, literals []Literal) {
 	}
 }
 
-func (db *Database) ask(l Literal) []result {
+// ask searches for all results of l. If the search fails or ctx is done, nothing from it is
+// merged into the database's cache.
+func (db *Database) ask(ctx context.Context, l Literal) ([]result, error) {
+	return db.solve(ctx, l, nil)
+}
+
+// askConjunction searches for all results of c's head, solving c's body as though c were a
+// rule. c's head uses conjunctionPredicate, so its results are not merged into the cache,
+// though those of the subgoals searched for its body are.
+func (db *Database) askConjunction(ctx context.Context, c Clause) ([]result, error) {
+	return db.solve(ctx, c.Head, &c)
+}
+
+func (db *Database) solve(ctx context.Context, l Literal, rule *Clause) ([]result, error) {
 	// Initialize
 	goal := goal{
+		ctx:      ctx,
 		db:       db,
 		l:        l,
 		subgoals: map[uuid.UUID]*subgoal{},
 		chains:   map[uuid.UUID]*chain{},
+		pending:  map[batchKey]*pendingBatch{},
 		varCount: db.vars,
 	}
-	id, _ := goal.putSubgoal(l, emptyEnvironment(), []dependent{})
+	id, _, err := goal.putSubgoal(l, emptyEnvironment(), []dependent{})
+	if err != nil {
+		return nil, err
+	}
 
-	goal.visitSubgoal(id)
+	if rule == nil {
+		err = goal.visitSubgoal(id)
+	} else {
+		err = goal.visitRule(id, *rule)
+	}
+	if err == nil {
+		err = goal.flushExternal()
+	}
+	if GoalGraphHook != nil {
+		var buf bytes.Buffer
+		goal.writeDOT(&buf)
+		GoalGraphHook(buf.String())
+	}
+	if err != nil {
+		return nil, err
+	}
 
 	db.resultsMutex.Lock()
-	for id, sg := range goal.subgoals {
-		trace("merging", id, sg.Literal.id(), sg.Literal)
-		db.mergeResults(sg.Literal, id, sg.results)
-		db.recordInvalidations(sg.Literal, id, sg.invalidators)
+	for sid, sg := range goal.subgoals {
+		if rule != nil && sid == id {
+			continue
+		}
+		trace("merging", sid, sg.Literal.id(), sg.Literal)
+		db.mergeResults(sg.Literal, sid, sg.results, sg.alternatives)
+		db.recordInvalidations(sg.Literal, sid, sg.invalidators)
 	}
 	db.resultsMutex.Unlock()
 
@@ -185,22 +282,72 @@ func (db *Database) ask(l Literal) []result {
 		results = append(results, r)
 	}
 
-	return results
+	return results, nil
 }
 
 func (db *Database) Assert(c Clause) error {
-	err := db.checkClause(c)
+	c, err := db.checkAndSchedule(c)
 	if err != nil {
 		return err
 	}
-	c = preprocess(c)
 
 	db.internMutex.Lock()
 	db.clauseMutex.Lock()
-	defer db.internMutex.Unlock()
-	defer db.clauseMutex.Unlock()
 	fresh, _ := freshen(c, &db.vars)
 	id := fresh.id()
-	db.clauses[id] = fresh
+	_, exists := db.clauses[id]
+	if !exists {
+		if db.checkOnAssert {
+			errs := db.checkArities(fresh, false)
+			if len(errs) > 0 {
+				db.clauseMutex.Unlock()
+				db.internMutex.Unlock()
+				return errs[0]
+			}
+		}
+		err = db.addDependencies(fresh)
+		if err != nil {
+			db.clauseMutex.Unlock()
+			db.internMutex.Unlock()
+			return err
+		}
+		db.addDefinition(fresh.Head)
+	}
+	db.storeClause(id, fresh)
+	db.clauseMutex.Unlock()
+	db.internMutex.Unlock()
+
+	// Any cached subgoal that the new clause could answer is now stale.
+	if !exists {
+		db.invalidateHead(fresh.Head)
+	}
+	return nil
+}
+
+// Retract removes a clause from the database. The clause is matched against stored clauses
+// up to variable renaming; retracting a clause that was never asserted does nothing.
+// All cached results that the clause could have contributed to are invalidated.
+func (db *Database) Retract(c Clause) error {
+	c, err := db.scheduleForRetract(c)
+	if err != nil {
+		return err
+	}
+	tag := c.tag()
+
+	db.clauseMutex.Lock()
+	var retracted []Clause
+	for _, id := range db.index.candidates(c.Head) {
+		if stored := db.clauses[id]; stored.tag() == tag {
+			retracted = append(retracted, stored)
+			db.deleteClause(id)
+			db.removeDependencies(stored)
+			db.removeDefinition(stored.Head)
+		}
+	}
+	db.clauseMutex.Unlock()
+
+	for _, r := range retracted {
+		db.invalidateHead(r.Head)
+	}
 	return nil
 }
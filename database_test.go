@@ -2,6 +2,8 @@ package authalog
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
 	"strings"
 	"testing"
 )
@@ -13,7 +15,7 @@ func parseApplyExecute(t *testing.T, prog string) string {
 		t.Errorf("Error parsing: %s", err)
 		t.Fail()
 	}
-	var results []result
+	var results []Answer
 	for _, c := range cmds {
 		results, err = db.Apply(c)
 		if err != nil {
@@ -209,15 +211,69 @@ bar(A, B, C, D, E, F, G, H, I, J, K)?
 		expected: `bar(a, a, a, a, a, a, a, a, a, a, a).
 `,
 	},
-	// 	pCase{
-	// 		name: "retraction",
-	// 		prog: `foo(a,b).
-	//     foo(b,c).
-	//     foo(a,b)~
-	//     foo(X,Y)?`,
-	// 		expected: `foo(b, c).
-	// `,
-	// 	},
+	pCase{
+		name: "retraction",
+		prog: `foo(a,b).
+    foo(b,c).
+    foo(a,b)~
+    foo(X,Y)?`,
+		expected: `foo(b, c).
+`,
+	},
+	pCase{
+		name: "retractRule",
+		prog: `foo(a). foo(b). bar(a).
+		baz(X) :- foo(X).
+		baz(X) :- bar(X).
+		baz(Y) :- foo(Y)~
+		baz(X)?`,
+		expected: `baz(a).
+`,
+	},
+	pCase{
+		name: "numbers",
+		prog: `level(alice, 3). level(bob, 1). level(carol, 2.5). level(dave, '3').
+		senior(U) :- level(U, L), L >= 2.
+		senior(U)?`,
+		expected: `senior(alice).
+senior(carol).
+`,
+	},
+	pCase{
+		name: "comparisons",
+		prog: `n(-1). n(0). n(1.5). n(2).
+		pair(A, B) :- A < B, n(A), n(B), A != -1, !n(3), B <= 1.5.
+		pair(A, B)?`,
+		expected: `pair(0, 1.5).
+`,
+	},
+	pCase{
+		name: "atomComparisons",
+		prog: `expires(a, '2024-01-01'). expires(b, '2025-06-30').
+		valid(X) :- expires(X, D), D > '2025-01-01'.
+		valid(X)?`,
+		expected: `valid(b).
+`,
+	},
+	pCase{
+		name: "cachedResults",
+		prog: `n(4). n(0).
+		a(Y) :- n(Y).
+		n(X)?
+		a(Y)?`,
+		expected: `a(4).
+a(0).
+`,
+	},
+	pCase{
+		name: "conjunctiveQuery",
+		prog: `users(1, admin). users(2, editor). users(3, viewer).
+		allowed(admin, 'Edit', 'Post'). allowed(editor, 'Edit', 'Post'). allowed(viewer, 'View', 'Post').
+		banned(2).
+		users(U, R), allowed(R, 'Edit', 'Post'), !banned(U), U < 3?`,
+		expected: `users(1, admin), allowed(admin, 'Edit', 'Post'), !banned(1), 1 < 3.
+`,
+	},
 }
 
 func compareDatalogResult(t *testing.T, result string, expected string) {
@@ -258,7 +314,7 @@ func TestProofStruct(t *testing.T) {
 		t.Errorf("Error parsing: %s", err)
 		t.Fail()
 	}
-	var results []result
+	var results []Answer
 	for _, c := range cmds {
 		results, err = db.Apply(c)
 		if err != nil {
@@ -284,3 +340,506 @@ baz(1, 3).` {
 		}
 	}
 }
+
+func TestAnswerBindings(t *testing.T) {
+	db := dbFromString(t, `
+	parent(john, douglas).
+	parent(bob, john).
+	grandparent(A, C) :- parent(A, B), parent(B, C).
+	`)
+	answers, err := db.Query(db.L("grandparent", V("Old"), "douglas"))
+	if err != nil {
+		t.Error(err)
+	}
+	if len(answers) != 1 {
+		t.Fatal("Expected 1 answer, got", len(answers))
+	}
+	b := answers[0].Bindings()
+	if len(b) != 1 || b["Old"] != "bob" {
+		t.Errorf("Unexpected bindings: %v", b)
+	}
+	if answers[0].Proof() != `grandparent(bob, douglas) :- parent(bob, john), parent(john, douglas).
+parent(bob, john).
+parent(john, douglas).
+` {
+		t.Errorf("Unexpected proof: %v", answers[0].Proof())
+	}
+}
+
+func TestConjunctiveQueries(t *testing.T) {
+	db := dbFromString(t, `
+	parent(john, douglas).
+	parent(bob, john).
+	parent(bob, alice).
+	age(john, 40). age(alice, 35). age(douglas, 12).
+	`)
+	answers, err := db.Apply(Ask(db.L("parent", "bob", V("Child")), db.L("age", V("Child"), V("Age"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answers) != 2 {
+		t.Fatal("Expected 2 answers, got", len(answers))
+	}
+	for _, a := range answers {
+		b := a.Bindings()
+		if len(b) != 2 || !(b["Child"] == "john" && b["Age"] == "40" || b["Child"] == "alice" && b["Age"] == "35") {
+			t.Errorf("Unexpected bindings: %v", b)
+		}
+		if len(a.Body) != 2 || a.Literal.Predicate != "parent" {
+			t.Errorf("Expected the answer to hold both literals, got %v", a.Body)
+		}
+	}
+
+	children := db.ParseCommandOrPanic("q(C, N) :- N = count{ G : parent(C, G) }.").Body[0]
+	answers, err = db.QueryConjunction(db.L("parent", V("P"), V("C")), db.L("age", V("C"), V("A")), db.L("lt", V("A"), 20), children)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareDatalogResult(t, db.ToString(answers), "parent(john, douglas), age(douglas, 12), 12 < 20, 0 = count{ G : parent(douglas, G) }.\n")
+	if proof := answers[0].Proof(); proof != "parent(john, douglas).\nage(douglas, 12).\n12 < 20. % From external relation lt(12, 20)\n" {
+		t.Errorf("Unexpected proof: %v", proof)
+	}
+
+	cmd := db.ParseCommandOrPanic("parent(P, C), !age(C, 12)?")
+	var buf bytes.Buffer
+	db.writeClause(&buf, &Clause{Head: cmd.Head, Body: cmd.Body}, cmd.CommandType)
+	if buf.String() != "parent(P, C), !age(C, 12)?\n" {
+		t.Errorf("Expected conjunctive queries to print as they are written, got %v", buf.String())
+	}
+
+	for query, expected := range map[string]string{
+		"parent(P, C), !age(X, 12)?": "variable 'X' bound in negated literal",
+		"parent(P, C), X > 3?":       "variable 'X' in X > 3 is not bound",
+	} {
+		_, err := db.Apply(db.ParseCommandOrPanic(query))
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected %v to be rejected with %v, got %v", query, expected, err)
+		}
+	}
+	// The head that conjunctions are solved under cannot be given rules of its own
+	err = db.Assert(Clause{Head: db.L(conjunctionPredicate, V("C")), Body: []Literal{db.L("parent", "bob", V("C"))}})
+	if err == nil || !strings.Contains(err.Error(), "reserved") {
+		t.Errorf("Expected a clause for %v to be rejected, got %v", conjunctionPredicate, err)
+	}
+	for _, bad := range []string{"parent(P, C), age(C, A).", "parent(P, C), age(C, A) :- x(P)?"} {
+		_, err := db.Parse(strings.NewReader(bad))
+		if err == nil {
+			t.Errorf("Expected %v not to parse", bad)
+		}
+	}
+}
+
+func TestStratification(t *testing.T) {
+	cases := []struct {
+		prog  string
+		cycle string
+	}{
+		{`p(X) :- q(X), !p(X).`, "(p -> p)"},
+		{`p(X) :- q(X), !r(X).
+		r(X) :- s(X), p(X).`, "(r -> p -> r)"},
+		{`p(X) :- q(X), !r(X).
+		r(X) :- s(X), t(X).
+		t(X) :- p(X).`, "(t -> p -> r -> t)"},
+	}
+	for _, c := range cases {
+		db := NewDatabase()
+		cmds, err := db.Parse(strings.NewReader(c.prog))
+		if err != nil {
+			t.Error(err)
+		}
+		for _, cmd := range cmds {
+			_, err = db.Apply(cmd)
+		}
+		if err == nil || !strings.Contains(err.Error(), c.cycle) {
+			t.Errorf("Expected an error naming %v, got %v", c.cycle, err)
+		}
+	}
+
+	// Recursion and negation are fine, so long as they are not on the same cycle
+	db := dbFromString(t, `
+	p(X) :- q(X), !r(X).
+	r(X) :- s(X), r(X).
+	p(X) :- q(X), p(X).
+	`)
+	// Once the negation is retracted, the cycle through it may be closed
+	_, err := db.Apply(db.ParseCommandOrPanic("p(X) :- q(X), !r(X)~"))
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = db.Apply(db.ParseCommandOrPanic("r(X) :- p(X)."))
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNumbers(t *testing.T) {
+	db := NewDatabase()
+	for _, str := range []string{"3", "-12", "2.5", "-0.25", "4.0", "'3'", "2abc", "007", "'1.50'", "'-0'"} {
+		cmd := db.ParseCommandOrPanic("n(" + str + ").")
+		if printed := db.termString(cmd.Head.Terms[0]); printed != str {
+			t.Errorf("Expected %v to print as itself, got %v", str, printed)
+		}
+	}
+	for str, kind := range map[string]TermKind{"3": KindInt, "2.5": KindFloat, "'3'": KindAtom, "2abc": KindAtom, "007": KindAtom, "1.50": KindAtom, "-0": KindAtom, "-0.0": KindAtom} {
+		cmd := db.ParseCommandOrPanic("n(" + str + ").")
+		if cmd.Head.Terms[0].Kind != kind {
+			t.Errorf("Expected %v to be of kind %v, got %v", str, kind, cmd.Head.Terms[0].Kind)
+		}
+	}
+	if db.L("n", 3).Terms[0] != db.ParseCommandOrPanic("n(3).").Head.Terms[0] {
+		t.Error("Expected Go integers to be numeric terms")
+	}
+
+	for _, prog := range []string{
+		`p(X) :- X > 3.`,
+		`p(C) :- q(A), C = A + B.`,
+		`p(D) :- q(A), D = C * 2, C = D + A.`,
+		`p(X) :- q(X), X < Y.`,
+		`p(X) :- q(X), !r(Y), X != Y.`,
+	} {
+		cmd := db.ParseCommandOrPanic(prog)
+		_, err := db.Apply(cmd)
+		if err == nil || !strings.Contains(err.Error(), "is not bound in a positive literal") {
+			t.Errorf("Expected %v to be rejected for comparing an unbound variable, got %v", prog, err)
+		}
+	}
+
+	for _, prog := range []string{`lt(a, b).`, `neq(X, Y) :- n(X), n(Y).`, `ge(1, 2)~`} {
+		_, err := db.Apply(db.ParseCommandOrPanic(prog))
+		if err == nil || !strings.Contains(err.Error(), "1:1: ") || !strings.Contains(err.Error(), "is built in") {
+			t.Errorf("Expected %v to be rejected for defining a comparison, got %v", prog, err)
+		}
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	db := dbFromString(t, `quota(alice, 10). used(alice, 7). quota(bob, 4). used(bob, 4).
+	% Operations may be written before the literals that bind their operands
+	remaining(U, R) :- R = Q - N, quota(U, Q), used(U, N), R > 0.
+	scaled(U, S) :- D = R * 2.5, S = D / 2, remaining(U, R).
+	parity(U, P) :- P = N % 2, used(U, N). % a comment after the modulus
+	n(4). n(0).
+	half(X, H) :- n(X), H = X / 2.
+	% Integer division truncates, and division by zero has no result
+	inverse(X, I) :- n(X), I = 1 / X.
+	check(X) :- n(X), 2 = X / 2.
+	% Operators need not be spaced, even the '-' that names may contain
+	less(X, L) :- n(X), L = X-1.
+	negated(X, M) :- n(X), M = -1-X.
+	`)
+	cases := map[string]string{
+		"remaining(U, R)?": "remaining(alice, 3).\n",
+		"scaled(U, S)?":    "scaled(alice, 3.75).\n",
+		"parity(U, P)?":    "parity(alice, 1).\nparity(bob, 0).\n",
+		"half(X, H)?":      "half(4, 2).\nhalf(0, 0).\n",
+		"inverse(X, I)?":   "inverse(4, 0).\n",
+		"check(X)?":        "check(4).\n",
+		"less(X, L)?":      "less(4, 3).\nless(0, -1).\n",
+		"negated(X, M)?":   "negated(4, -5).\nnegated(0, -1).\n",
+	}
+	for query, expected := range cases {
+		answers, err := db.Apply(db.ParseCommandOrPanic(query))
+		if err != nil {
+			t.Error(err)
+		}
+		compareDatalogResult(t, db.ToString(answers), expected)
+	}
+
+	for _, prog := range []string{`add(1, 2, x).`, `mod(A, B, C) :- quota(A, B), used(A, C).`, `mul(1, 2, 2)~`} {
+		_, err := db.Apply(db.ParseCommandOrPanic(prog))
+		if err == nil || !strings.Contains(err.Error(), "1:1: ") || !strings.Contains(err.Error(), "is built in") {
+			t.Errorf("Expected %v to be rejected for defining an arithmetic operation, got %v", prog, err)
+		}
+	}
+
+	c := db.ParseCommandOrPanic("p(C) :- q(A, B), C = A % B.")
+	if printed := db.clauseString(Clause{Head: c.Head, Body: c.Body}); printed != "p(C) :- q(A, B), C = A % B." {
+		t.Errorf("Expected arithmetic to print infix, got %v", printed)
+	}
+}
+
+func TestAggregates(t *testing.T) {
+	db := dbFromString(t, `
+	user(alice). user(bob). user(carol).
+	member(alice, admins). member(alice, auditors). member(bob, admins).
+	level(alice, 3). level(alice, 5). level(bob, 2).
+	approver(U) :- user(U), N = count{ G : member(U, G) }, N >= 2.
+	groups(U, N) :- user(U), N = count{ G : member(U, G) }.
+	clearance(U, L) :- user(U), L = max{ X : level(U, X) }.
+	floor(U, L) :- user(U), L = min{ X : level(U, X) }.
+	total(T) :- T = sum{ X : level(U, X) }.
+	`)
+	cases := []struct {
+		query    string
+		expected string
+	}{
+		{"approver(U)?", "approver(alice).\n"},
+		{"groups(U, N)?", "groups(alice, 2).\ngroups(bob, 1).\ngroups(carol, 0).\n"},
+		{"clearance(U, L)?", "clearance(alice, 5).\nclearance(bob, 2).\n"},
+		{"floor(U, L)?", "floor(alice, 3).\nfloor(bob, 2).\n"},
+		{"total(T)?", "total(10).\n"},
+	}
+	for _, c := range cases {
+		answers, err := db.Apply(db.ParseCommandOrPanic(c.query))
+		if err != nil {
+			t.Error(err)
+		}
+		compareDatalogResult(t, db.ToString(answers), c.expected)
+	}
+
+	tree, err := db.ProofTree(db.L("approver", "alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tree.Derivations) != 1 || len(tree.Derivations[0].Aggregates) != 1 {
+		t.Fatalf("Expected a single derivation through an aggregate, got %+v", tree.Derivations)
+	}
+	if agg := db.literalString(tree.Derivations[0].Aggregates[0]); !strings.HasPrefix(agg, "2 = count{ ") {
+		t.Errorf("Expected the aggregate's result to be bound, got %v", agg)
+	}
+
+	e, err := db.WhyNot(db.L("approver", "bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(e.String(), "failed at 1 >= 2") {
+		t.Errorf("Expected approver(bob) to fail at its comparison, got %v", e)
+	}
+
+	c := db.ParseCommandOrPanic("p(U, N) :- user(U), N = sum{ X : level(U, X) }.")
+	if printed := db.clauseString(Clause{Head: c.Head, Body: c.Body}); printed != "p(U, N) :- user(U), N = sum{ X : level(U, X) }." {
+		t.Errorf("Expected aggregates to print as they are written, got %v", printed)
+	}
+
+	// Aggregates are recomputed when the facts they range over change
+	_, err = db.Apply(db.ParseCommandOrPanic("member(carol, admins)."))
+	if err != nil {
+		t.Error(err)
+	}
+	answers, err := db.Apply(db.ParseCommandOrPanic("groups(carol, N)?"))
+	if err != nil {
+		t.Error(err)
+	}
+	compareDatalogResult(t, db.ToString(answers), "groups(carol, 1).\n")
+
+	for prog, expected := range map[string]string{
+		`p(N) :- N = count{ X : p(X) }.`:               "aggregation inside recursion",
+		`p(N) :- N = count{ X : q(Y) }.`:               "aggregated variable 'X' does not appear in q(Y)",
+		`p(U, N) :- N = count{ G : member(U, G) }.`:    "variable 'U' in N = count{ G : member(U, G) } is not bound",
+		`p(N) :- q(X), N = count{ X : member(X, N) }.`: "cannot also appear in member(X, N)",
+	} {
+		_, err := db.Apply(db.ParseCommandOrPanic(prog))
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected %v to be rejected with %v, got %v", prog, expected, err)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	db := dbFromString(t, `
+	parent(john, douglas).
+	parent(bob, john, extra).
+	grandparent(A, C) :- parent(A, B), parent(B, C).
+	ancestor(A, B) :- parnet(A, B).
+	child(A, B) :- grandparent(A, B, C).
+	sibling(A, B) :- parent(P, A), parent(P, B), A in [john, bob], !same(A, B).
+	`)
+	errs := db.Check()
+	expected := []string{
+		"2:2: parent is defined with different numbers of arguments: 2 or 3",
+		"5:2: in a rule for ancestor/2: parnet/2 is not defined by any clause or external relation",
+		"6:2: in a rule for child/2: grandparent called with 3 arguments, but is defined with 2",
+		"7:2: in a rule for sibling/2: same/2 is not defined by any clause or external relation",
+	}
+	if len(errs) != len(expected) {
+		t.Errorf("Expected %v errors, got %v", len(expected), errs)
+	}
+	for i := range errs {
+		if i < len(expected) && errs[i].Error() != expected[i] {
+			t.Errorf("Expected error '%v', got '%v'", expected[i], errs[i])
+		}
+	}
+
+	db = NewDatabase()
+	db.SetCheckOnAssert(true)
+	for _, prog := range []string{"foo(a).", "bar(X) :- foo(X).", "baz(X) :- undefinedYet(X)."} {
+		_, err := db.Apply(db.ParseCommandOrPanic(prog))
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	for _, prog := range []string{"foo(a, b).", "bar(X) :- foo(X, Y)."} {
+		_, err := db.Apply(db.ParseCommandOrPanic(prog))
+		if err == nil {
+			t.Error("Expected an arity error asserting", prog)
+		}
+	}
+	if errs := db.Check(); len(errs) != 1 {
+		t.Error("Expected only undefinedYet to be reported, got", errs)
+	}
+}
+
+func TestParsePositions(t *testing.T) {
+	db := NewDatabase()
+	cmds, err := db.ParseFile("policy.dl", strings.NewReader(`foo(a).
+% comment
+bar(X) :-
+	foo(X).
+`))
+	if err != nil {
+		t.Error(err)
+	}
+	if len(cmds) != 2 {
+		t.Fatal("Expected 2 commands, got", len(cmds))
+	}
+	if s := cmds[1].Span.Start.String(); s != "policy.dl:3:1" {
+		t.Error("Unexpected start position", s)
+	}
+	if s := cmds[1].Span.End.String(); s != "policy.dl:4:9" {
+		t.Error("Unexpected end position", s)
+	}
+
+	errorCases := []struct {
+		prog     string
+		expected string
+	}{
+		{"foo(a).\nbar(X) :- foo(X) baz(X).", "policy.dl:2:18: Expected '.', '~' or ',', but got b"},
+		{"foo(a).\n  foo(a b).", "policy.dl:2:9: Expected ,, but got b"},
+		{"foo(a).\nfoo(a)", "policy.dl:2:7: unexpected end of input"},
+		{"foo('a).", "policy.dl:1:8: Expected ' to close a quoted atom, but reached the end of input"},
+		{`foo("a\q").`, `policy.dl:1:8: Unknown escape sequence \q in a quoted atom`},
+	}
+	for _, c := range errorCases {
+		_, err := NewDatabase().ParseFile("policy.dl", strings.NewReader(c.prog))
+		if err == nil || err.Error() != c.expected {
+			t.Errorf("Expected error '%v', got '%v'", c.expected, err)
+		}
+	}
+
+	// Static errors point back to the clause
+	_, err = db.Apply(db.ParseCommandOrPanic("\n\n  baz(X) :- !foo(X)."))
+	if err == nil || !strings.HasPrefix(err.Error(), "3:3: ") {
+		t.Error("Expected an error at 3:3, got", err)
+	}
+}
+
+func TestQuotedAtoms(t *testing.T) {
+	db := dbFromString(t, `
+	owner('alice@example.com', "org/123:doc").
+	owner("o'brien", 'C:\\Users\\o\'brien').
+	owner('', "line\nbreak").
+	owner(bob, 'Über straße 名前').
+	`)
+	answers, err := db.Apply(db.ParseCommandOrPanic("owner(U, R)?"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `owner('alice@example.com', 'org/123:doc').
+owner('o\'brien', 'C:\\Users\\o\'brien').
+owner('', 'line\nbreak').
+owner(bob, 'Über straße 名前').
+`
+	compareDatalogResult(t, db.ToString(answers), expected)
+
+	// Printed answers read back as the same atoms
+	roundTrip := NewDatabase()
+	cmds, err := roundTrip.Parse(strings.NewReader(db.ToString(answers)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cmds {
+		roundTrip.Apply(c)
+	}
+	answers, err = roundTrip.Apply(roundTrip.ParseCommandOrPanic("owner(U, R)?"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareDatalogResult(t, roundTrip.ToString(answers), expected)
+
+	answers, err = db.Query(db.L("owner", V("U"), "C:\\Users\\o'brien"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answers) != 1 || answers[0].Bindings()["U"] != "o'brien" {
+		t.Errorf("Expected o'brien to own their home directory, got %v", db.ToString(answers))
+	}
+}
+
+func TestProofTree(t *testing.T) {
+	db := NewDatabase()
+	cmds, err := db.ParseFile("policy.dl", strings.NewReader(`foo(a). foo(b). bar(a). baz(b).
+qux(X) :- foo(X), !bar(X).
+qux(X) :- baz(X).
+qux(X)?`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cmds {
+		_, err = db.Apply(c)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	tree, err := db.ProofTree(db.L("qux", "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tree.Derivations) != 2 {
+		t.Fatal("Expected 2 derivations, got", len(tree.Derivations))
+	}
+	for _, d := range tree.Derivations {
+		if len(d.Premises) != 1 || len(d.Premises[0].Derivations) != 1 {
+			t.Errorf("Expected a single proven premise, got %+v", d)
+		}
+	}
+
+	b, err := json.Marshal(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(b)
+	for _, expected := range []string{
+		`"literal":"qux(b)"`,
+		`{"clause":"qux(b) :- foo(b), !bar(b).","position":"policy.dl:2:1","external":false,"premises":[{"literal":"foo(b)","derivations":[{"clause":"foo(b).","position":"policy.dl:1:9","external":false,"premises":[],"absent":[]}]}],"absent":["!bar(b)"]}`,
+		`{"clause":"qux(b) :- baz(b).","position":"policy.dl:3:1"`,
+	} {
+		if !strings.Contains(s, expected) {
+			t.Errorf("Expected JSON to contain %v, got %v", expected, s)
+		}
+	}
+
+	_, err = db.ProofTree(db.L("qux", "a"))
+	if err == nil {
+		t.Error("Expected an error for a literal with no proof")
+	}
+}
+
+func TestDOT(t *testing.T) {
+	db := dbFromString(t, `foo(a). foo(b). bar(a).
+	baz(X) :- foo(X), !bar(X).`)
+
+	var goalGraph string
+	GoalGraphHook = func(dot string) { goalGraph = dot }
+	_, err := db.Apply(db.ParseCommandOrPanic("baz(X)?"))
+	GoalGraphHook = nil
+	if err != nil {
+		t.Error(err)
+	}
+	for _, expected := range []string{"digraph goal {", `[label="baz(X)\n1 results"]`, `[label="foo(_G`, `[label="!bar(b)", shape=box]`} {
+		if !strings.Contains(goalGraph, expected) {
+			t.Errorf("Expected goal graph to contain %v, got:\n%v", expected, goalGraph)
+		}
+	}
+
+	var buf bytes.Buffer
+	err = db.ProofDOT(db.L("baz", "b"), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"digraph proof {", `[label="baz(b)"]`, `[label="baz(b) :- foo(b), !bar(b).\n2:2", shape=box]`, `[label="!bar(b)", style=dashed]`, `[label="foo(b).\n1:9"`} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("Expected proof graph to contain %v, got:\n%v", expected, buf.String())
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package authalog
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// ProofDOT writes the graph of recorded proofs of l, and recursively of their premises, to w in
+// Graphviz DOT format. Literals are drawn as ellipses, and the clauses deriving them as boxes.
+// Negated premises, which hold because they have no proof, are drawn dashed, and aggregates
+// dotted.
+func (db *Database) ProofDOT(l Literal, w io.Writer) error {
+	db.resultsMutex.RLock()
+	defer db.resultsMutex.RUnlock()
+	db.clauseMutex.RLock()
+	defer db.clauseMutex.RUnlock()
+
+	if _, ok := db.proofs[l.id()]; !ok {
+		return fmt.Errorf("no proof of %v", db.literalString(l))
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("digraph proof {\n")
+
+	visited := map[uuid.UUID]struct{}{}
+	toVisit := []Literal{l}
+	for len(toVisit) > 0 {
+		l := toVisit[0]
+		toVisit = toVisit[1:]
+		id := l.id()
+		if _, ok := visited[id]; ok {
+			continue
+		}
+		visited[id] = struct{}{}
+
+		if l.Negated {
+			fmt.Fprintf(&buf, "\t%q [label=%q, style=dashed];\n", id.String(), db.literalString(l))
+			continue
+		}
+		if l.isAggregate() {
+			fmt.Fprintf(&buf, "\t%q [label=%q, style=dotted];\n", id.String(), db.literalString(l))
+			continue
+		}
+		fmt.Fprintf(&buf, "\t%q [label=%q];\n", id.String(), db.literalString(l))
+
+		derivations := map[string]Clause{}
+		origins := map[string]struct{}{}
+		for _, p := range db.proofs[id] {
+			if p.external != nil {
+				origins[db.originString(*p.external)] = struct{}{}
+				continue
+			}
+			if c, ok := db.clauses[p.Clause]; ok {
+				c = resolved(p.substitutions, c)
+				derivations[c.String()] = c
+			}
+		}
+		originKeys := make([]string, 0, len(origins))
+		for k := range origins {
+			originKeys = append(originKeys, k)
+		}
+		sort.Strings(originKeys)
+		for i, k := range originKeys {
+			node := fmt.Sprintf("external:%v:%v", id.String(), i)
+			fmt.Fprintf(&buf, "\t%q [label=%q, shape=box, style=rounded];\n", node, k)
+			fmt.Fprintf(&buf, "\t%q -> %q;\n", id.String(), node)
+		}
+
+		keys := make([]string, 0, len(derivations))
+		for k := range derivations {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			c := derivations[k]
+			node := "clause:" + c.id().String()
+			label := db.clauseString(c)
+			if c.Span.Start.IsValid() {
+				label += "\n" + c.Span.Start.String()
+			}
+			fmt.Fprintf(&buf, "\t%q [label=%q, shape=box];\n", node, label)
+			fmt.Fprintf(&buf, "\t%q -> %q;\n", id.String(), node)
+			for _, b := range c.Body {
+				if b.Negated {
+					fmt.Fprintf(&buf, "\t%q -> %q [style=dashed];\n", node, b.id().String())
+				} else if b.isAggregate() {
+					fmt.Fprintf(&buf, "\t%q -> %q [style=dotted];\n", node, b.id().String())
+				} else {
+					fmt.Fprintf(&buf, "\t%q -> %q;\n", node, b.id().String())
+				}
+				toVisit = append(toVisit, b)
+			}
+		}
+	}
+
+	buf.WriteString("}\n")
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// writeDOT writes the goal's graph of subgoals and chains to w in Graphviz DOT format.
+// Subgoals are drawn as ellipses, labeled with their literal and number of results, and chains
+// as boxes labeled with the body literals that remain to be solved. Edges point from each
+// subgoal or chain to its dependents, and dotted edges from each chain to the chains it
+// continues into.
+func (g *goal) writeDOT(w io.Writer) error {
+	var buf bytes.Buffer
+	buf.WriteString("digraph goal {\n")
+
+	subgoalIDs := make([]uuid.UUID, 0, len(g.subgoals))
+	for id := range g.subgoals {
+		subgoalIDs = append(subgoalIDs, id)
+	}
+	sortIDs(subgoalIDs)
+	for _, id := range subgoalIDs {
+		sg := g.subgoals[id]
+		label := fmt.Sprintf("%v\n%v results", g.db.literalString(sg.Literal), len(sg.results))
+		fmt.Fprintf(&buf, "\t%q [label=%q];\n", id.String(), label)
+		for _, d := range sg.dependents {
+			fmt.Fprintf(&buf, "\t%q -> %q;\n", id.String(), d.recieverID.String())
+		}
+	}
+
+	chainIDs := make([]uuid.UUID, 0, len(g.chains))
+	for id := range g.chains {
+		chainIDs = append(chainIDs, id)
+	}
+	sortIDs(chainIDs)
+	for _, id := range chainIDs {
+		c := g.chains[id]
+		body := make([]string, len(c.body))
+		for i, l := range c.body {
+			body[i] = g.db.literalString(l)
+		}
+		fmt.Fprintf(&buf, "\t%q [label=%q, shape=box];\n", id.String(), strings.Join(body, ",\n"))
+		for _, d := range c.dependents {
+			fmt.Fprintf(&buf, "\t%q -> %q;\n", id.String(), d.recieverID.String())
+		}
+		next := map[uuid.UUID]struct{}{}
+		for _, rn := range c.results {
+			if rn.next != uuid.Nil {
+				next[rn.next] = struct{}{}
+			}
+		}
+		nextIDs := make([]uuid.UUID, 0, len(next))
+		for n := range next {
+			nextIDs = append(nextIDs, n)
+		}
+		sortIDs(nextIDs)
+		for _, n := range nextIDs {
+			fmt.Fprintf(&buf, "\t%q -> %q [style=dotted];\n", id.String(), n.String())
+		}
+	}
+
+	buf.WriteString("}\n")
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+func sortIDs(ids []uuid.UUID) {
+	sort.Slice(ids, func(i, j int) bool { return bytes.Compare(ids[i].Bytes(), ids[j].Bytes()) < 0 })
+}
+
+func (db *Database) clauseString(c Clause) string {
+	var buf bytes.Buffer
+	db.writeClause(&buf, &c, CommandAssert)
+	return strings.TrimSpace(buf.String())
+}
@@ -116,7 +116,7 @@ func (t Term) unify(other Term, env *environment) bool {
 }
 
 func unify(a Literal, b Literal, in *environment) bool {
-	if a.Predicate != b.Predicate || len(a.Terms) != len(b.Terms) {
+	if a.Predicate != b.Predicate || a.Aggregate != b.Aggregate || len(a.Terms) != len(b.Terms) {
 		return false
 	}
 
@@ -146,6 +146,7 @@ func freshenIn(l Literal, count *int64, env *environment) Literal {
 		Negated:   l.Negated,
 		Predicate: l.Predicate,
 		Terms:     make([]Term, len(l.Terms)),
+		Aggregate: l.Aggregate,
 	}
 	for i, v := range l.Terms {
 		if v.IsConstant {
@@ -167,7 +168,7 @@ func freshenIn(l Literal, count *int64, env *environment) Literal {
 
 func freshen(c Clause, counter *int64) (Clause, environment) {
 	resultEnv := emptyEnvironment()
-	result := Clause{}
+	result := Clause{Span: c.Span}
 	result.Head = freshenIn(c.Head, counter, &resultEnv)
 	result.Body = make([]Literal, len(c.Body))
 	for i, l := range c.Body {
@@ -201,6 +202,7 @@ func (env environment) rewrite(l Literal) Literal {
 		Negated:   l.Negated,
 		Predicate: l.Predicate,
 		Terms:     make([]Term, len(l.Terms)),
+		Aggregate: l.Aggregate,
 	}
 	for i, t := range l.Terms {
 		result.Terms[i] = env.chase(t)
@@ -217,7 +219,8 @@ func (env environment) rewriteClause(c Clause) Clause {
 		newBody[i] = env.rewrite(c)
 	}
 	return Clause{
-		newHead,
-		newBody,
+		Head: newHead,
+		Body: newBody,
+		Span: c.Span,
 	}
 }
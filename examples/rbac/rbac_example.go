@@ -15,6 +15,9 @@ type RBACAuthorizer struct {
 
 var policy = `
 checkResource(User, Action, Resource) :-
+	grantingRole(User, Action, Resource, Role).
+
+grantingRole(User, Action, Resource, Role) :-
 	resourceType(Resource, ResourceType),
 	users(User, Role),
 	allowed(Role, Action, ResourceType).
@@ -53,6 +56,7 @@ func NewRBACAuthorizer(db *sql.DB) (*RBACAuthorizer, error) {
 		Table:   "users",
 		Columns: []string{"id", "role"},
 		Types:   []interface{}{0, Reader},
+		Numbers: true,
 	}, db)
 	if err != nil {
 		return nil, err
@@ -61,6 +65,7 @@ func NewRBACAuthorizer(db *sql.DB) (*RBACAuthorizer, error) {
 		Table:   "posts",
 		Columns: []string{"id"},
 		Types:   []interface{}{0},
+		Numbers: true,
 	}, db)
 	if err != nil {
 		return nil, err
@@ -69,6 +74,7 @@ func NewRBACAuthorizer(db *sql.DB) (*RBACAuthorizer, error) {
 		Table:   "comments",
 		Columns: []string{"id"},
 		Types:   []interface{}{0},
+		Numbers: true,
 	}, db)
 	if err != nil {
 		return nil, err
@@ -89,6 +95,9 @@ func NewRBACAuthorizer(db *sql.DB) (*RBACAuthorizer, error) {
 			return nil, err
 		}
 	}
+	if errs := rbac.db.Check(); len(errs) > 0 {
+		return nil, errs[0]
+	}
 	return &rbac, nil
 }
 
@@ -99,6 +108,22 @@ func (rbac *RBACAuthorizer) Check(user int, action Action, resource int) (bool,
 	return len(results) != 0, err
 }
 
+// GrantingRole returns the role that permits user to take action on resource. The bool is false
+// if the user is not permitted.
+func (rbac *RBACAuthorizer) GrantingRole(user int, action Action, resource int) (Role, bool, error) {
+	answers, err := rbac.db.Query(
+		rbac.db.L("grantingRole", user, action, resource, authalog.V("Role")))
+	if err != nil || len(answers) == 0 {
+		return Reader, false, err
+	}
+	var role Role
+	err = role.Scan(answers[0].Bindings()["Role"])
+	if err != nil {
+		return Reader, false, err
+	}
+	return role, true, nil
+}
+
 func (rbac *RBACAuthorizer) CheckResourceType(user int, action Action, resourceType ResourceType) (bool, error) {
 	results, err := rbac.db.Apply(
 		authalog.Ask(
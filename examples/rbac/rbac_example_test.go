@@ -103,6 +103,21 @@ func TestRBAC(t *testing.T) {
 	assertTrue(rbac.CheckResourceType(1, Delete, Post))
 	assertTrue(rbac.Check(1, Delete, 22))
 
+	role, ok, err := rbac.GrantingRole(1, Delete, 22)
+	if err != nil {
+		t.Error(err)
+	}
+	if !ok || role != Admin {
+		t.Errorf("Expected Admin to grant access, got %v (%v)", role, ok)
+	}
+	_, ok, err = rbac.GrantingRole(2, Delete, 22)
+	if err != nil {
+		t.Error(err)
+	}
+	if ok {
+		t.Error("Expected no role to grant access")
+	}
+
 	p, err := rbac.Proof(1, Delete, 22)
 	if err != nil {
 		t.Error(err)
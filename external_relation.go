@@ -1,6 +1,13 @@
 package authalog
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	uuid "github.com/satori/go.uuid"
+)
 
 type interner interface {
 	// Interns a string. Multiple calls with the same string value will
@@ -18,19 +25,342 @@ type interner interface {
 type ExternalRelation struct {
 	head Literal
 	// External relations are responsible for correctly implementing several things:
-	// 	1. All possible variable/ground combinations for input terms
+	// 	1. All possible variable/ground combinations for input terms, or those of its modes
 	//  2. Looking up interned strings for constant atoms
 	//	3. Interning results
-	// external relations must return only constant terms
-	// TODO: why not have the infrastructure handle interning and conversion?
-	run func(interner, []Term) ([][]Term, error)
+	// external relations must return only constant terms, and should abandon work once
+	// the context is done.
+	// NewExternalRelation builds relations that leave interning and conversion to the engine.
+	run func(context.Context, interner, []Term) ([][]Term, error)
+	// batch, if set, is like run, but answers several calls at once, returning the tuples for
+	// each call in order. Calls to relations with batch are deferred while searching, so that
+	// they can be made together rather than one at a time.
+	batch func(context.Context, interner, [][]Term) ([][][]Term, error)
+	// describe, if set, fills in the source specific parts of the origins recorded in the
+	// proofs of facts returned for each of the given calls, which were made together.
+	describe func(interner, [][]Term) []ExternalOrigin
+	// modes, if set, are the binding patterns that run supports. See WithModes.
+	modes []string
+	// table, if set, is the SQL table that the relation reads, so that runs of literals over
+	// tables in the same database can be answered with a single join. See sqlJoin.
+	table *sqlTable
+}
+
+// WithModes returns a copy of r that declares the binding patterns it supports. Each mode has
+// one rune per argument: '+' for an argument that must be bound when the relation is called,
+// and '-' for one that the relation can fill in. For example, users(+, -) and users(-, +) are
+// declared with WithModes("+-", "-+").
+//
+// A relation with modes is only called once one of them is satisfied. Rules that call it are
+// reordered so that the arguments of one of its modes are bound first, and rejected with a
+// static error if no order can do so. Relations without modes are called however their
+// arguments are bound.
+func (r ExternalRelation) WithModes(modes ...string) (ExternalRelation, error) {
+	for _, m := range modes {
+		if len(m) != len(r.head.Terms) {
+			return ExternalRelation{}, fmt.Errorf("mode %v of %v/%v should have one rune per argument", m, r.head.Predicate, len(r.head.Terms))
+		}
+		for _, ch := range m {
+			if ch != '+' && ch != '-' {
+				return ExternalRelation{}, fmt.Errorf("mode %v of %v/%v may only contain '+' and '-'", m, r.head.Predicate, len(r.head.Terms))
+			}
+		}
+	}
+	r.modes = append([]string{}, modes...)
+	return r, nil
+}
+
+// supports returns true if r may be called in the mode call, as returned by callMode.
+func (r ExternalRelation) supports(call string) bool {
+	if len(r.modes) == 0 {
+		return true
+	}
+	for _, m := range r.modes {
+		if modeSatisfied(call, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// callMode returns the mode that terms call a relation in: '+' for each constant, and for
+// each variable in bound, and '-' for the others.
+func callMode(terms []Term, bound map[int64]struct{}) string {
+	mode := make([]byte, len(terms))
+	for i, t := range terms {
+		mode[i] = '-'
+		if _, ok := bound[t.Value]; t.IsConstant || ok {
+			mode[i] = '+'
+		}
+	}
+	return string(mode)
+}
+
+func modeSatisfied(call string, mode string) bool {
+	for i := range mode {
+		if mode[i] == '+' && call[i] != '+' {
+			return false
+		}
+	}
+	return true
+}
+
+// modeString formats a mode as it would be called, as in users(+, -).
+func modeString(predicate string, mode string) string {
+	args := make([]string, len(mode))
+	for i := range mode {
+		args[i] = string(mode[i])
+	}
+	return predicate + "(" + strings.Join(args, ", ") + ")"
+}
+
+func modeStrings(predicate string, modes []string) string {
+	strs := make([]string, len(modes))
+	for i, m := range modes {
+		strs[i] = modeString(predicate, m)
+	}
+	return strings.Join(strs, " or ")
+}
+
+// ExternalOrigin records the call to an external relation that produced a fact.
+type ExternalOrigin struct {
+	// The relation's predicate.
+	Relation string
+	// The literal the relation was called with. Its constant terms were the bound inputs.
+	Input Literal
+	// For SQL relations, the table that was queried and the query that produced the row.
+	Table string
+	Query string
+}
+
+// Value is an argument passed to, or returned from, a relation built with NewExternalRelation.
+// Arguments that are bound hold the constant's string form; unbound arguments are variables
+// that the relation is expected to fill in. Returned values are read as the text syntax reads
+// unquoted constants: numerals such as 40 or 2.5 become numbers, and anything else, including
+// text like 007, an atom. Values made with Atom, such as IDs that happen to be numerals, are
+// always atoms. Values that repeat the bound argument in the same position are returned
+// unchanged.
+type Value struct {
+	IsBound  bool
+	Constant string
+	// IsAtom is set for bound arguments that are atoms, and for returned values that must be
+	// read as atoms.
+	IsAtom bool
+}
+
+// Bound returns a Value bound to the given constant.
+func Bound(constant string) Value {
+	return Value{IsBound: true, Constant: constant}
+}
+
+// Atom returns a Value bound to the given constant, which is read as an atom even if it is a
+// numeral.
+func Atom(constant string) Value {
+	return Value{IsBound: true, Constant: constant, IsAtom: true}
+}
+
+// NewExternalRelation creates an external relation backed by a Go function. fn is called with
+// one Value per argument, and returns the matching tuples; every value in a returned tuple must
+// be bound. fn may return tuples that do not match the bound arguments -- they are filtered out
+// by the engine.
+func NewExternalRelation(predicate string, arity int, fn func(args []Value) ([][]Value, error)) ExternalRelation {
+	return NewExternalRelationContext(predicate, arity, func(_ context.Context, args []Value) ([][]Value, error) {
+		return fn(args)
+	})
+}
+
+// NewExternalRelationContext is like NewExternalRelation, but fn also recieves the context of
+// the query that called it.
+func NewExternalRelationContext(predicate string, arity int, fn func(ctx context.Context, args []Value) ([][]Value, error)) ExternalRelation {
+	return ExternalRelation{
+		head: Literal{
+			Predicate: predicate,
+			Terms:     makeVars(arity),
+		},
+		run: func(ctx context.Context, in interner, terms []Term) ([][]Term, error) {
+			args := valuesFor(in, terms)
+			tuples, err := fn(ctx, args)
+			if err != nil {
+				return nil, err
+			}
+			return termsFor(in, predicate, terms, args, tuples)
+		},
+	}
 }
 
-func (g *goal) runExternalRule(sg *subgoal, rel ExternalRelation) error {
-	tuples, err := rel.run(g.db, sg.Literal.Terms)
+// NewBatchExternalRelation creates an external relation backed by a Go function that answers
+// several calls at once. While searching, calls to the relation are gathered together, and fn
+// is called with the arguments of each, as for NewExternalRelation. It returns the matching
+// tuples for each call, in the same order.
+func NewBatchExternalRelation(predicate string, arity int, fn func(ctx context.Context, calls [][]Value) ([][][]Value, error)) ExternalRelation {
+	r := ExternalRelation{
+		head: Literal{
+			Predicate: predicate,
+			Terms:     makeVars(arity),
+		},
+	}
+	r.batch = func(ctx context.Context, in interner, calls [][]Term) ([][][]Term, error) {
+		args := make([][]Value, len(calls))
+		for i, terms := range calls {
+			args[i] = valuesFor(in, terms)
+		}
+		tuples, err := fn(ctx, args)
+		if err != nil {
+			return nil, err
+		}
+		if len(tuples) != len(calls) {
+			return nil, fmt.Errorf("%v/%v returned tuples for %v calls, but was called %v times", predicate, arity, len(tuples), len(calls))
+		}
+		results := make([][][]Term, len(calls))
+		for i, terms := range calls {
+			results[i], err = termsFor(in, predicate, terms, args[i], tuples[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+		return results, nil
+	}
+	r.run = func(ctx context.Context, in interner, terms []Term) ([][]Term, error) {
+		results, err := r.batch(ctx, in, [][]Term{terms})
+		if err != nil {
+			return nil, err
+		}
+		return results[0], nil
+	}
+	return r
+}
+
+// valuesFor converts the terms a relation was called with to the Values passed to Go
+// functions.
+func valuesFor(in interner, terms []Term) []Value {
+	args := make([]Value, len(terms))
+	for i, t := range terms {
+		if t.isNumber() {
+			args[i] = Bound(constantString(in, t))
+		} else if t.IsConstant {
+			args[i] = Atom(in.lookup(t.Value))
+		}
+	}
+	return args
+}
+
+// termsFor converts the tuples returned by a Go function called with args back to terms.
+func termsFor(in interner, predicate string, terms []Term, args []Value, tuples [][]Value) ([][]Term, error) {
+	arity := len(terms)
+	results := make([][]Term, len(tuples))
+	for i, tuple := range tuples {
+		if len(tuple) != arity {
+			return nil, fmt.Errorf("%v/%v returned a tuple with %v values", predicate, arity, len(tuple))
+		}
+		results[i] = make([]Term, arity)
+		for j, v := range tuple {
+			if !v.IsBound {
+				return nil, fmt.Errorf("%v/%v returned an unbound value at position %v", predicate, arity, j)
+			}
+			if args[j].IsBound && args[j].Constant == v.Constant {
+				// Keep the kind of bound arguments that are returned as they were passed
+				results[i][j] = terms[j]
+			} else if n, ok := parseNumber(v.Constant); ok && !v.IsAtom {
+				results[i][j] = n
+			} else {
+				results[i][j] = Term{IsConstant: true, Value: in.intern(v.Constant)}
+			}
+		}
+	}
+	return results, nil
+}
+
+// pendingBatch gathers the subgoals calling a batched relation that have yet to be run.
+type pendingBatch struct {
+	relation ExternalRelation
+	subgoals []uuid.UUID
+}
+
+// batchKey identifies one of the external relations providing a predicate.
+type batchKey struct {
+	relation indexKey
+	index    int
+}
+
+func (g *goal) runExternalRule(sg *subgoal, rel ExternalRelation, key batchKey) error {
+	if call := callMode(sg.Literal.Terms, nil); !rel.supports(call) {
+		return fmt.Errorf("%v cannot be called as %v; it supports %v", g.db.literalString(sg.Literal), modeString(rel.head.Predicate, call), modeStrings(rel.head.Predicate, rel.modes))
+	}
+	if rel.batch != nil {
+		b, ok := g.pending[key]
+		if !ok {
+			b = &pendingBatch{relation: rel}
+			g.pending[key] = b
+		}
+		b.subgoals = append(b.subgoals, subgoalHash(sg.Literal))
+		return nil
+	}
+	tuples, err := rel.run(g.ctx, g.db, sg.Literal.Terms)
 	if err != nil {
-		return fmt.Errorf("In %v, got error: %v", rel.head, err)
+		return fmt.Errorf("In %v, got error: %w", rel.head, err)
+	}
+	origin := ExternalOrigin{}
+	if rel.describe != nil {
+		origin = rel.describe(g.db, [][]Term{sg.Literal.Terms})[0]
 	}
+	return g.mergeExternalTuples(sg, rel, origin, tuples)
+}
+
+// flushExternal runs the deferred calls to batched external relations, making one batch of
+// calls to each relation, until running them defers no more.
+func (g *goal) flushExternal() error {
+	for len(g.pending) > 0 {
+		keys := make([]batchKey, 0, len(g.pending))
+		for k := range g.pending {
+			keys = append(keys, k)
+		}
+		// Run batches in a stable order, so that searches are repeatable
+		sort.Slice(keys, func(i, j int) bool {
+			a, b := keys[i], keys[j]
+			if a.relation.predicate != b.relation.predicate {
+				return a.relation.predicate < b.relation.predicate
+			}
+			if a.relation.arity != b.relation.arity {
+				return a.relation.arity < b.relation.arity
+			}
+			return a.index < b.index
+		})
+		pending := g.pending
+		g.pending = map[batchKey]*pendingBatch{}
+
+		for _, k := range keys {
+			b := pending[k]
+			rel := b.relation
+			calls := make([][]Term, len(b.subgoals))
+			for i, id := range b.subgoals {
+				calls[i] = g.subgoals[id].Literal.Terms
+			}
+			trace("Running batch", rel.head, len(calls))
+			tuples, err := rel.batch(g.ctx, g.db, calls)
+			if err != nil {
+				return fmt.Errorf("In %v, got error: %w", rel.head, err)
+			}
+			if len(tuples) != len(calls) {
+				return fmt.Errorf("In %v, got tuples for %v calls, but made %v", rel.head, len(tuples), len(calls))
+			}
+			origins := make([]ExternalOrigin, len(calls))
+			if rel.describe != nil {
+				origins = rel.describe(g.db, calls)
+			}
+			for i, id := range b.subgoals {
+				err = g.mergeExternalTuples(g.subgoals[id], rel, origins[i], tuples[i])
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (g *goal) mergeExternalTuples(sg *subgoal, rel ExternalRelation, origin ExternalOrigin, tuples [][]Term) error {
+	origin.Relation = rel.head.Predicate
+	origin.Input = sg.Literal
 	for _, tuple := range tuples {
 		r := Literal{Predicate: sg.Literal.Predicate, Terms: tuple}
 		// Unify with the target. Doing this allows us to generate an env,
@@ -39,11 +369,18 @@ func (g *goal) runExternalRule(sg *subgoal, rel ExternalRelation) error {
 		env := emptyEnvironment()
 		ok := unify(r, sg.Literal, &env)
 		if ok {
-			g.mergeResultIntoSubgoal(sg, result{
+			err := g.mergeResultIntoSubgoal(sg, result{
 				env:     env,
 				Literal: r,
-				// TODO: proof? invalidators?
+				proof: proof{
+					success:  true,
+					external: &origin,
+				},
+				// TODO: invalidators?
 			})
+			if err != nil {
+				return err
+			}
 		} else {
 			trace("Did not unify", r, "into", sg.Literal)
 		}
@@ -1,6 +1,9 @@
 package authalog
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"strings"
 	"testing"
 	"time"
@@ -25,7 +28,7 @@ var testRelation = ExternalRelation{
 			},
 		},
 	},
-	run: func(i interner, terms []Term) ([][]Term, error) {
+	run: func(_ context.Context, i interner, terms []Term) ([][]Term, error) {
 		d := [][]string{
 			{"a", "b"},
 			{"a", "c"},
@@ -62,7 +65,7 @@ func TestExternalRule(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	var results []result
+	var results []Answer
 	for _, c := range cmds {
 		results, err = db.Apply(c)
 		if err != nil {
@@ -104,3 +107,334 @@ func TestInvalidatingExternalRule(t *testing.T) {
 		t.Error("Expected 0 results after starting invalidator, but got", len(db.results))
 	}
 }
+
+func TestGoExternalRelation(t *testing.T) {
+	managers := map[string][]string{
+		"alice": {"bob", "carol"},
+		"bob":   {"dave"},
+	}
+	manages := NewExternalRelation("manages", 2, func(args []Value) ([][]Value, error) {
+		var results [][]Value
+		for manager, reports := range managers {
+			if args[0].IsBound && args[0].Constant != manager {
+				continue
+			}
+			for _, r := range reports {
+				results = append(results, []Value{Bound(manager), Bound(r)})
+			}
+		}
+		return results, nil
+	})
+
+	db := NewDatabase()
+	db.AddExternalRelations(manages)
+	cmds, err := db.Parse(strings.NewReader(`
+	above(X, Y) :- manages(X, Y).
+	above(X, Y) :- manages(X, Z), above(Z, Y).
+	above(alice, Y)?`))
+	if err != nil {
+		t.Error(err)
+	}
+	var results []Answer
+	for _, c := range cmds {
+		results, err = db.Apply(c)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	compareDatalogResult(t, db.ToString(results),
+		`above(alice, bob).
+above(alice, carol).
+above(alice, dave).
+`)
+
+	// Bound arguments the function ignores are filtered by the engine
+	results, err = db.Apply(db.ParseCommandOrPanic("manages(bob, carol)?"))
+	if err != nil {
+		t.Error(err)
+	}
+	if len(results) != 0 {
+		t.Error("Expected 0 results, got", db.ToString(results))
+	}
+}
+
+func TestExternalRelationError(t *testing.T) {
+	failing := NewExternalRelation("failing", 1, func(args []Value) ([][]Value, error) {
+		return nil, fmt.Errorf("connection refused")
+	})
+	db := dbFromString(t, `
+	foo(a).
+	bar(X) :- foo(X), failing(X).
+	`)
+	db.AddExternalRelations(failing)
+
+	_, err := db.Apply(db.ParseCommandOrPanic("bar(X)?"))
+	if err == nil {
+		t.Error("Expected an error from the failing relation")
+	}
+	if len(db.results) != 0 {
+		t.Error("Expected 0 cached results after a failed query, got", len(db.results))
+	}
+}
+
+func TestExternalRelationContext(t *testing.T) {
+	slow := NewExternalRelationContext("slow", 1, func(ctx context.Context, args []Value) ([][]Value, error) {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+			return [][]Value{{Bound("a")}}, nil
+		}
+	})
+	db := dbFromString(t, `
+	foo(a).
+	bar(X) :- foo(X), slow(X).
+	`)
+	db.AddExternalRelations(slow)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := db.QueryContext(ctx, db.L("bar", V("X")))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("Expected a deadline exceeded error, got", err)
+	}
+	if len(db.results) != 0 {
+		t.Error("Expected 0 cached results after a cancelled query, got", len(db.results))
+	}
+
+	// A context that is already done stops the search before it starts
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = db.QueryContext(ctx, db.L("foo", V("X")))
+	if err != context.Canceled {
+		t.Error("Expected context.Canceled, got", err)
+	}
+}
+
+func TestExternalRelationModes(t *testing.T) {
+	users := map[string]string{"u1": "admin", "u2": "editor"}
+	calls := []string{}
+	rel, err := NewExternalRelation("users", 2, func(args []Value) ([][]Value, error) {
+		calls = append(calls, callMode([]Term{{IsConstant: args[0].IsBound}, {IsConstant: args[1].IsBound}}, nil))
+		var results [][]Value
+		for id, role := range users {
+			if (!args[0].IsBound || args[0].Constant == id) && (!args[1].IsBound || args[1].Constant == role) {
+				results = append(results, []Value{Bound(id), Bound(role)})
+			}
+		}
+		return results, nil
+	}).WithModes("+-", "-+")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := NewDatabase()
+	db.AddExternalRelations(rel)
+	dbErr := func(prog string) error {
+		cmds, err := db.Parse(strings.NewReader(prog))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range cmds {
+			if _, err := db.Apply(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err = dbErr(`
+	named(u1, loki). named(u2, quincy).
+	role(N, R) :- users(U, R), named(U, N).
+	admin(U) :- users(U, admin).
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// users is called once named has bound its first argument
+	results, err := db.Apply(db.ParseCommandOrPanic("role(N, R)?"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareDatalogResult(t, db.ToString(results), "role(loki, admin).\nrole(quincy, editor).\n")
+	results, err = db.Apply(db.ParseCommandOrPanic("admin(U)?"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareDatalogResult(t, db.ToString(results), "admin(u1).\n")
+	for _, c := range calls {
+		if c == "--" {
+			t.Errorf("Expected users never to be called without a bound argument, got %v", calls)
+		}
+	}
+
+	for prog, expected := range map[string]string{
+		"all(U, R) :- users(U, R).":                    "users(U, R) would be called as users(-, -), but users/2 can only be called as users(+, -) or users(-, +)",
+		"count(N) :- N = count{ U : users(U, R) }.":    "users(U, R) would be called as users(-, -)",
+		"unused(U) :- named(U, N), !users(X, editor).": "bound in negated literal",
+	} {
+		err := dbErr(prog)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected %v to be rejected with %v, got %v", prog, expected, err)
+		}
+	}
+
+	_, err = db.Apply(db.ParseCommandOrPanic("users(U, R)?"))
+	if err == nil || !strings.Contains(err.Error(), "cannot be called as users(-, -)") {
+		t.Errorf("Expected querying users without a bound argument to fail, got %v", err)
+	}
+
+	for _, modes := range [][]string{{"+"}, {"+*"}} {
+		if _, err := rel.WithModes(modes...); err == nil {
+			t.Errorf("Expected modes %v to be rejected", modes)
+		}
+	}
+}
+
+func TestExternalRelationModesAddedLater(t *testing.T) {
+	users := map[string]string{"u1": "admin", "u2": "editor"}
+	rel, err := NewExternalRelation("users", 2, func(args []Value) ([][]Value, error) {
+		if !args[0].IsBound {
+			return nil, fmt.Errorf("users called without a bound id")
+		}
+		return [][]Value{{args[0], Bound(users[args[0].Constant])}}, nil
+	}).WithModes("+-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The rules are asserted before the relation declares its modes
+	db := dbFromString(t, `
+	member(u1). member(u2).
+	r(U, R) :- users(U, R), member(U).
+	`)
+	if errs := db.Check(); len(errs) != 1 {
+		t.Errorf("Expected users to be reported as undefined, got %v", errs)
+	}
+	db.AddExternalRelations(rel)
+	if errs := db.Check(); len(errs) != 0 {
+		t.Errorf("Expected no errors once r is reordered, got %v", errs)
+	}
+	answers, err := db.Apply(db.ParseCommandOrPanic("r(U, R)?"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareDatalogResult(t, db.ToString(answers), "r(u1, admin).\nr(u2, editor).\n")
+
+	// Rules that no order can satisfy are reported by Check
+	db = dbFromString(t, `all(U, R) :- users(U, R).`)
+	db.AddExternalRelations(rel)
+	errs := db.Check()
+	expected := "would be called as users(-, -), but users/2 can only be called as users(+, -)"
+	if len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), "1:1: ") || !strings.Contains(errs[0].Error(), expected) {
+		t.Errorf("Expected %v, got %v", expected, errs)
+	}
+
+	// and can still be retracted
+	_, err = db.Apply(db.ParseCommandOrPanic("all(U, R) :- users(U, R)~"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := db.Check(); len(errs) != 0 {
+		t.Errorf("Expected no errors once the rule is retracted, got %v", errs)
+	}
+}
+
+func TestBatchExternalRelation(t *testing.T) {
+	roles := map[string]string{"loki": "admin", "quincy": "editor", "flo": "viewer"}
+	batches := [][][]Value{}
+	rel := NewBatchExternalRelation("role", 2, func(ctx context.Context, calls [][]Value) ([][][]Value, error) {
+		batches = append(batches, calls)
+		results := make([][][]Value, len(calls))
+		for i, args := range calls {
+			if role, ok := roles[args[0].Constant]; ok {
+				results[i] = [][]Value{{args[0], Bound(role)}}
+			}
+		}
+		return results, nil
+	})
+
+	newDB := func() *Database {
+		db := dbFromString(t, `
+		user(loki). user(quincy). user(flo). user(arlo).
+		privileged(U) :- user(U), role(U, admin).
+		unprivileged(U) :- user(U), !privileged(U).
+		`)
+		db.AddExternalRelations(rel)
+		return db
+	}
+
+	db := newDB()
+	answers, err := db.Apply(db.ParseCommandOrPanic("privileged(U)?"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareDatalogResult(t, db.ToString(answers), "privileged(loki).\n")
+
+	// Each user's role is looked up together
+	if len(batches) != 1 || len(batches[0]) != 4 {
+		t.Errorf("Expected a single batch of 4 calls, got %v", batches)
+	}
+
+	// Negated literals wait for the calls they depend on
+	db = newDB()
+	answers, err = db.Apply(db.ParseCommandOrPanic("unprivileged(U)?"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareDatalogResult(t, db.ToString(answers), "unprivileged(quincy).\nunprivileged(flo).\nunprivileged(arlo).\n")
+
+	// So are the calls made by a conjunctive query
+	db = newDB()
+	batches = nil
+	answers, err = db.QueryConjunction(db.L("user", V("U")), db.L("role", V("U"), "admin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareDatalogResult(t, db.ToString(answers), "user(loki), role(loki, admin).\n")
+	if len(batches) != 1 || len(batches[0]) != 4 {
+		t.Errorf("Expected a single batch of 4 calls, got %v", batches)
+	}
+
+	// Called directly, the relation answers a batch of one
+	answers, err = db.Query(db.L("role", "quincy", V("R")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareDatalogResult(t, db.ToString(answers), "role(quincy, editor).\n")
+}
+
+func TestExternalRelationNumbers(t *testing.T) {
+	// Only canonical numerals are numbers, unless the relation asks for an atom
+	ages := map[string]Value{"loki": Bound("40"), "quincy": Bound("12.5"), "flo": Bound("unknown"), "bo": Bound("007"), "arlo": Atom("18")}
+	rel := NewExternalRelation("age", 2, func(args []Value) ([][]Value, error) {
+		var results [][]Value
+		for name, age := range ages {
+			results = append(results, []Value{Bound(name), age})
+		}
+		return results, nil
+	})
+	db := dbFromString(t, `
+	adult(N) :- age(N, A), A >= 18.
+	known(N, A) :- age(N, A), A > 0.
+	total(S) :- S = sum{ A : known(N, A) }.
+	`)
+	db.AddExternalRelations(rel)
+
+	cases := map[string]string{
+		"adult(N)?":     "adult(loki).\n",
+		"age(N, 40)?":   "age(loki, 40).\n",
+		"age(flo, A)?":  "age(flo, unknown).\n",
+		"total(S)?":     "total(52.5).\n",
+		"age(N, 12.5)?": "age(quincy, 12.5).\n",
+		"age(bo, A)?":   "age(bo, 007).\n",
+		"age(arlo, A)?": "age(arlo, '18').\n",
+	}
+	for query, expected := range cases {
+		answers, err := db.Apply(db.ParseCommandOrPanic(query))
+		if err != nil {
+			t.Fatal(err)
+		}
+		compareDatalogResult(t, db.ToString(answers), expected)
+	}
+}
@@ -1,7 +1,14 @@
 package authalog
 
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+)
+
 type groundSet struct {
-	items []int64
+	items []Term
 }
 
 var isIn = ExternalRelation{
@@ -9,7 +16,7 @@ var isIn = ExternalRelation{
 		Predicate: "in",
 		Terms:     makeVars(2),
 	},
-	run: func(intern interner, terms []Term) ([][]Term, error) {
+	run: func(_ context.Context, intern interner, terms []Term) ([][]Term, error) {
 		if !terms[1].IsConstant {
 			panic("in/2 should be syntactically gauranteed to only recieve constant sets")
 		}
@@ -17,7 +24,7 @@ var isIn = ExternalRelation{
 		s := intern.getSet(terms[1].Value)
 		if terms[0].IsConstant {
 			for _, v := range s.items {
-				if v == terms[0].Value {
+				if v == terms[0] {
 					return [][]Term{terms}, nil
 				}
 			}
@@ -25,8 +32,94 @@ var isIn = ExternalRelation{
 		}
 		results := make([][]Term, len(s.items))
 		for i, v := range s.items {
-			results[i] = []Term{Term{IsConstant: true, Value: v}, terms[1]}
+			results[i] = []Term{v, terms[1]}
 		}
 		return results, nil
 	},
 }
+
+func sortTerms(ts []Term) {
+	sort.Slice(ts, func(i, j int) bool {
+		if ts[i].Kind != ts[j].Kind {
+			return ts[i].Kind < ts[j].Kind
+		}
+		return ts[i].Value < ts[j].Value
+	})
+}
+
+// arithmeticOperators maps each built in arithmetic relation to the infix operator that
+// denotes it, as in 'C = A + B' for add(A, B, C).
+var arithmeticOperators = map[string]string{
+	"add": "+",
+	"sub": "-",
+	"mul": "*",
+	"div": "/",
+	"mod": "%",
+}
+
+// Builtin arithmetic relations. Each relates two bound numbers to the result of its operation
+// on them. The result is an integer when both inputs are integers, and a float otherwise.
+// Integer division truncates, and division by zero has no result.
+var arithmetic = []ExternalRelation{
+	arithmeticRelation("add",
+		func(a, b int64) (int64, bool) { return a + b, true },
+		func(a, b float64) (float64, bool) { return a + b, true }),
+	arithmeticRelation("sub",
+		func(a, b int64) (int64, bool) { return a - b, true },
+		func(a, b float64) (float64, bool) { return a - b, true }),
+	arithmeticRelation("mul",
+		func(a, b int64) (int64, bool) { return a * b, true },
+		func(a, b float64) (float64, bool) { return a * b, true }),
+	arithmeticRelation("div",
+		func(a, b int64) (int64, bool) { return safeDivide(a, b, func(a, b int64) int64 { return a / b }) },
+		func(a, b float64) (float64, bool) { return a / b, b != 0 }),
+	arithmeticRelation("mod",
+		func(a, b int64) (int64, bool) { return safeDivide(a, b, func(a, b int64) int64 { return a % b }) },
+		func(a, b float64) (float64, bool) { return math.Mod(a, b), b != 0 }),
+}
+
+func safeDivide(a, b int64, op func(a, b int64) int64) (int64, bool) {
+	if b == 0 {
+		return 0, false
+	}
+	return op(a, b), true
+}
+
+func arithmeticRelation(predicate string, intOp func(a, b int64) (int64, bool), floatOp func(a, b float64) (float64, bool)) ExternalRelation {
+	return ExternalRelation{
+		head: Literal{
+			Predicate: predicate,
+			Terms:     makeVars(3),
+		},
+		run: func(_ context.Context, _ interner, terms []Term) ([][]Term, error) {
+			a, b := terms[0], terms[1]
+			if !a.IsConstant || !b.IsConstant {
+				return nil, fmt.Errorf("%v/3 can only be evaluated once its first two arguments are bound", predicate)
+			}
+			if !a.isNumber() || !b.isNumber() {
+				return [][]Term{}, nil
+			}
+			var result Term
+			if a.Kind == KindInt && b.Kind == KindInt {
+				r, ok := intOp(a.Value, b.Value)
+				if !ok {
+					return [][]Term{}, nil
+				}
+				result = intTerm(r)
+			} else {
+				r, ok := floatOp(a.float(), b.float())
+				if !ok {
+					return [][]Term{}, nil
+				}
+				result = floatTerm(r)
+			}
+			// A bound result that does not match is filtered out by the engine
+			return [][]Term{{a, b, result}}, nil
+		},
+	}
+}
+
+func isArithmetic(l Literal) bool {
+	_, ok := arithmeticOperators[l.Predicate]
+	return ok && len(l.Terms) == 3 && !l.isAggregate()
+}
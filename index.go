@@ -0,0 +1,120 @@
+package authalog
+
+import (
+	uuid "github.com/satori/go.uuid"
+)
+
+// indexKey identifies a set of clause heads. With a position of -1, it identifies every head
+// with a predicate and arity. Otherwise it identifies the heads that also have constant at
+// position, or any variable there if variable is set.
+type indexKey struct {
+	predicate string
+	arity     int
+	position  int
+	variable  bool
+	constant  Term
+}
+
+func predicateKey(l Literal) indexKey {
+	return indexKey{
+		predicate: l.Predicate,
+		arity:     len(l.Terms),
+		position:  -1,
+	}
+}
+
+func argumentKey(l Literal, position int) indexKey {
+	k := indexKey{
+		predicate: l.Predicate,
+		arity:     len(l.Terms),
+		position:  position,
+	}
+	if t := l.Terms[position]; t.IsConstant {
+		k.constant = t
+	} else {
+		k.variable = true
+	}
+	return k
+}
+
+// clauseIndex maps the keys of each stored clause's head to the clause's id, so that the
+// clauses whose heads might unify with a literal can be found without trying every clause.
+type clauseIndex map[indexKey]map[uuid.UUID]struct{}
+
+func (ix clauseIndex) keys(head Literal) []indexKey {
+	keys := make([]indexKey, 0, len(head.Terms)+1)
+	keys = append(keys, predicateKey(head))
+	for i := range head.Terms {
+		keys = append(keys, argumentKey(head, i))
+	}
+	return keys
+}
+
+func (ix clauseIndex) add(id uuid.UUID, head Literal) {
+	for _, k := range ix.keys(head) {
+		ids, ok := ix[k]
+		if !ok {
+			ids = map[uuid.UUID]struct{}{}
+			ix[k] = ids
+		}
+		ids[id] = struct{}{}
+	}
+}
+
+func (ix clauseIndex) remove(id uuid.UUID, head Literal) {
+	for _, k := range ix.keys(head) {
+		delete(ix[k], id)
+		if len(ix[k]) == 0 {
+			delete(ix, k)
+		}
+	}
+}
+
+// candidates returns the ids of the clauses whose heads might unify with l: those with l's
+// predicate and arity, narrowed by whichever of l's constant arguments is most selective.
+// A head matches a constant argument if it has the same constant, or a variable, there.
+func (ix clauseIndex) candidates(l Literal) []uuid.UUID {
+	best := ix[predicateKey(l)]
+	var variables map[uuid.UUID]struct{}
+	for i, t := range l.Terms {
+		if !t.IsConstant {
+			continue
+		}
+		constant := argumentKey(l, i)
+		variable := constant
+		variable.variable = true
+		variable.constant = Term{}
+		if len(ix[constant])+len(ix[variable]) < len(best)+len(variables) {
+			best, variables = ix[constant], ix[variable]
+		}
+	}
+
+	ids := make([]uuid.UUID, 0, len(best)+len(variables))
+	for id := range best {
+		ids = append(ids, id)
+	}
+	for id := range variables {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// must be called while holding clauseMutex
+func (db *Database) storeClause(id uuid.UUID, c Clause) {
+	db.clauses[id] = c
+	db.index.add(id, c.Head)
+}
+
+// must be called while holding clauseMutex
+func (db *Database) deleteClause(id uuid.UUID) {
+	if c, ok := db.clauses[id]; ok {
+		delete(db.clauses, id)
+		db.index.remove(id, c.Head)
+	}
+}
+
+// externalRelationsFor returns the external relations whose heads might unify with l.
+// must be called while holding clauseMutex
+func (db *Database) externalRelationsFor(l Literal) []ExternalRelation {
+	return db.externalRelations[predicateKey(l)]
+}
@@ -0,0 +1,75 @@
+package authalog
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestClauseIndex(t *testing.T) {
+	db := dbFromString(t, `
+	p(a, X) :- q(X).
+	p(b, c).
+	p(X, c) :- q(X).
+	q(a).
+	`)
+
+	heads := func(l Literal) map[string]struct{} {
+		found := map[string]struct{}{}
+		for _, id := range db.index.candidates(l) {
+			found[db.literalString(db.clauses[id].Head)] = struct{}{}
+		}
+		return found
+	}
+	cases := []struct {
+		l        Literal
+		expected int
+	}{
+		// Heads with a or a variable first
+		{db.L("p", "a", V("Y")), 2},
+		// c is no more selective than the predicate alone
+		{db.L("p", V("Y"), "c"), 3},
+		{db.L("p", "b", "c"), 2},
+		{db.L("q", "b"), 0},
+		{db.L("q", "a", "a"), 0},
+	}
+	for _, c := range cases {
+		if found := heads(c.l); len(found) != c.expected {
+			t.Errorf("Expected %v candidates for %v, got %v", c.expected, db.literalString(c.l), found)
+		}
+	}
+
+	_, err := db.Apply(db.ParseCommandOrPanic("p(X, c) :- q(X)~"))
+	if err != nil {
+		t.Error(err)
+	}
+	if found := heads(db.L("p", "a", V("Y"))); len(found) != 1 {
+		t.Errorf("Expected retracted clauses to leave the index, got %v", found)
+	}
+	if _, ok := db.index[argumentKey(db.L("p", V("X"), "c"), 0)]; ok {
+		t.Errorf("Expected empty index entries to be removed")
+	}
+}
+
+func TestIndexedQueries(t *testing.T) {
+	db := NewDatabase()
+	for i := 0; i < 1000; i++ {
+		err := db.Assert(C(db.L("member", fmt.Sprintf("user%v", i), fmt.Sprintf("group%v", i%10))))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := db.Assert(C(db.L("admin", V("U")), db.L("member", V("U"), "group3")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if candidates := db.index.candidates(db.L("member", "user42", V("G"))); len(candidates) != 1 {
+		t.Errorf("Expected a single candidate fact, got %v", len(candidates))
+	}
+	answers, err := db.Query(db.L("admin", V("U")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answers) != 100 {
+		t.Errorf("Expected 100 admins, got %v", len(answers))
+	}
+}
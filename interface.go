@@ -1,6 +1,7 @@
 package authalog
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"strings"
@@ -11,12 +12,28 @@ type Term struct {
 	// TODO: we could bitpack this into the top bit of the int64 part.
 	// 2^63 is still plenty of symbols
 	IsConstant bool
-	// If term is a constant, value is the constant value.
+	// Kind distinguishes numeric constants from atoms. Variables are always KindAtom.
+	Kind TermKind
+	// If term is a constant, value is the constant value: an interned string for atoms, the
+	// integer itself for KindInt, and the bits of the float64 for KindFloat.
 	// If term is not a constant (ie, is a variable), value contains
 	// the variable's id.
 	Value int64
 }
 
+// TermKind is the kind of constant a term holds.
+type TermKind uint8
+
+const (
+	// KindAtom constants are interned strings.
+	KindAtom TermKind = iota
+	// KindInt constants are 64 bit integers.
+	KindInt
+	// KindFloat constants are 64 bit floating point numbers. They are distinct from integers
+	// of the same value; 3 and 3.0 do not unify.
+	KindFloat
+)
+
 // CommandType differentiates different possible datalog commands.
 type CommandType int
 
@@ -26,21 +43,31 @@ const (
 	// CommandQuery - this command will return the results of querying a database
 	// upon application.
 	CommandQuery
-	// TODO: implement retract
+	// CommandRetract - this fact or rule will be removed from a database upon application.
 	CommandRetract
 )
 
 // Command a command to mutate or query an authalog database.
 // TODO: Consider passing around commands that use strings, so that nobody ever sees a non-interned string?
 type Command struct {
-	Head        Literal
+	Head Literal
+	// Body is the body of an asserted or retracted rule. The body of a query holds the
+	// literals conjoined with its head, as in a(X), b(X)?.
 	Body        []Literal
 	CommandType CommandType
+	// Where the command was parsed from, if it was parsed.
+	Span Span
 }
 
 // Parse consumes a reader, producing a slice of Commands.
 func (db *Database) Parse(input io.Reader) ([]Command, error) {
-	s := newScanner(input, db)
+	return db.ParseFile("", input)
+}
+
+// ParseFile is like Parse, but records filename in the positions of parsed commands and
+// parse errors.
+func (db *Database) ParseFile(filename string, input io.Reader) ([]Command, error) {
+	s := newScanner(input, filename, db)
 
 	commands := make([]Command, 0)
 
@@ -54,7 +81,7 @@ func (db *Database) Parse(input io.Reader) ([]Command, error) {
 }
 
 func (db *Database) ParseCommandOrPanic(str string) Command {
-	s := newScanner(strings.NewReader(str), db)
+	s := newScanner(strings.NewReader(str), "", db)
 	c, _, err := s.scanOneCommand()
 	if err != nil {
 		panic(err)
@@ -63,28 +90,188 @@ func (db *Database) ParseCommandOrPanic(str string) Command {
 }
 
 // Apply applies a single command.
-func (db *Database) Apply(cmd Command) ([]result, error) {
+func (db *Database) Apply(cmd Command) ([]Answer, error) {
 	switch cmd.CommandType {
 	case CommandAssert:
 		c := Clause{
 			Head: cmd.Head,
 			Body: cmd.Body,
+			Span: cmd.Span,
 		}
 		return nil, db.Assert(c)
 	case CommandQuery:
-		res := db.ask(cmd.Head)
-		return res, nil
+		if len(cmd.Body) > 0 {
+			return db.QueryConjunction(append([]Literal{cmd.Head}, cmd.Body...)...)
+		}
+		return db.Query(cmd.Head)
+	case CommandRetract:
+		c := Clause{
+			Head: cmd.Head,
+			Body: cmd.Body,
+			Span: cmd.Span,
+		}
+		return nil, db.Retract(c)
 	default:
 		return nil, fmt.Errorf("bogus command - this should never happen")
 	}
 }
 
-// ToString reformats results for display.
-// Coincidentally, it also generates valid datalog.
-func (db *Database) ToString(results []result) string {
+// Query returns all answers to l. Errors raised while searching, such as a failing external
+// relation, are returned to the caller and leave the database's cache untouched.
+func (db *Database) Query(l Literal) ([]Answer, error) {
+	return db.QueryContext(context.Background(), l)
+}
+
+// QueryContext is like Query, but abandons the search with ctx.Err() once ctx is done. The
+// context is passed through to external relations.
+func (db *Database) QueryContext(ctx context.Context, l Literal) ([]Answer, error) {
+	results, err := db.ask(ctx, l)
+	if err != nil {
+		return nil, err
+	}
+	answers := make([]Answer, len(results))
+	for i, r := range results {
+		answers[i] = Answer{
+			Literal: r.Literal,
+			query:   []Literal{l},
+			db:      db,
+		}
+	}
+	return answers, nil
+}
+
+// conjunctionPredicate names the head of the clause that a conjunctive query is solved as.
+// Clauses cannot define it, so that no rule contributes to the query's answers.
+const conjunctionPredicate = "?-"
+
+// QueryConjunction returns the answers under which every one of ls holds, as for the query
+// users(U, R), allowed(R, 'Edit', 'Post')?. The literals are checked and ordered as the body
+// of a rule would be, so negated literals, built ins and aggregates may be used as they are
+// in rules.
+func (db *Database) QueryConjunction(ls ...Literal) ([]Answer, error) {
+	return db.QueryConjunctionContext(context.Background(), ls...)
+}
+
+// QueryConjunctionContext is like QueryConjunction, but abandons the search with ctx.Err()
+// once ctx is done.
+func (db *Database) QueryConjunctionContext(ctx context.Context, ls ...Literal) ([]Answer, error) {
+	if len(ls) == 0 {
+		return nil, fmt.Errorf("a query must have at least one literal")
+	}
+	// The conjunction is solved as the body of a rule whose head holds each of its
+	// variables, other than those local to an aggregate.
+	head := Literal{Predicate: conjunctionPredicate}
+	for _, l := range ls {
+		terms := l.Terms
+		if l.isAggregate() {
+			terms = terms[:1]
+		}
+		for _, t := range terms {
+			if !t.IsConstant && !containsTerm(head.Terms, t) {
+				head.Terms = append(head.Terms, t)
+			}
+		}
+	}
+	scheduled, err := db.checkAndScheduleConjunction(Clause{Head: head, Body: ls})
+	if err != nil {
+		return nil, err
+	}
+	results, err := db.askConjunction(ctx, scheduled)
+	if err != nil {
+		return nil, err
+	}
+
+	answers := make([]Answer, 0, len(results))
+	for _, r := range results {
+		env := emptyEnvironment()
+		if !unify(head, r.Literal, &env) {
+			return nil, fmt.Errorf("%v does not unify with %v", head, r.Literal)
+		}
+		body := make([]Literal, len(ls))
+		for i, l := range ls {
+			body[i] = env.rewrite(l)
+		}
+		answers = append(answers, Answer{
+			Literal: body[0],
+			Body:    body,
+			query:   ls,
+			db:      db,
+		})
+	}
+	return answers, nil
+}
+
+// Answer is a single answer to a query.
+type Answer struct {
+	// Literal is the query's literal, with every variable bound to a constant. For
+	// conjunctive queries, it is the first literal of Body.
+	Literal Literal
+	// Body holds each literal of a conjunctive query, with its variables bound. It is empty
+	// for queries of a single literal.
+	Body  []Literal
+	query []Literal
+	db    *Database
+}
+
+func (a Answer) literals() []Literal {
+	if len(a.Body) > 0 {
+		return a.Body
+	}
+	return []Literal{a.Literal}
+}
+
+// Bindings maps the names of the query's variables to the constants they were bound to.
+// Don't care variables ('_'), and those local to an aggregate, are omitted.
+func (a Answer) Bindings() map[string]string {
+	bindings := map[string]string{}
+	answered := a.literals()
+	for i, q := range a.query {
+		for j, t := range q.Terms {
+			if t.IsConstant || !answered[i].Terms[j].IsConstant {
+				continue
+			}
+			name := a.db.lookup(t.Value)
+			if name == "_" {
+				continue
+			}
+			bindings[name] = constantString(a.db, answered[i].Terms[j])
+		}
+	}
+	return bindings
+}
+
+// Proof returns the derivation of this answer, formatted as datalog. The derivations of each
+// literal of a conjunctive query are written in turn.
+func (a Answer) Proof() string {
+	premises := []Literal{}
+	for _, l := range a.literals() {
+		if !l.Negated && !l.isAggregate() {
+			premises = append(premises, l)
+		}
+	}
+	return a.db.proofString(premises)
+}
+
+// ProofTree returns every recorded derivation of this answer. For conjunctive queries, it is
+// the tree of Literal; the trees of the rest of Body can be found with Database.ProofTree.
+func (a Answer) ProofTree() (*ProofTree, error) {
+	return a.db.ProofTree(a.Literal)
+}
+
+// ToString reformats answers for display.
+// Coincidentally, answers to queries of a single literal are also valid datalog.
+func (db *Database) ToString(answers []Answer) string {
 	str := ""
-	for _, result := range results {
-		str += result.Literal.Predicate
+	for _, result := range answers {
+		if len(result.Body) > 0 {
+			body := make([]string, len(result.Body))
+			for i, l := range result.Body {
+				body[i] = db.literalString(l)
+			}
+			str += strings.Join(body, ", ") + ".\n"
+			continue
+		}
+		str += quoteAtom(result.Literal.Predicate)
 		if len(result.Literal.Terms) > 0 {
 			str += "("
 			termStrings := make([]string, len(result.Literal.Terms))
@@ -103,12 +290,19 @@ func (db *Database) ToString(results []result) string {
 type Clause struct {
 	Head Literal
 	Body []Literal
+	// Where the clause was parsed from, if it was parsed.
+	Span Span
 }
 
 type Literal struct {
 	Negated   bool
 	Predicate string
 	Terms     []Term
+	// Aggregate is the function of an aggregate literal, like N = count{ G : member(U, G) },
+	// and is empty for other literals. Aggregate literals hold the aggregated literal's
+	// predicate, and their terms are the result, the aggregated term, and then the aggregated
+	// literal's terms: N, G, U, G.
+	Aggregate string
 }
 
 func (l Literal) String() string {
@@ -116,13 +310,23 @@ func (l Literal) String() string {
 	if l.Negated {
 		ret = ret + "!"
 	}
+	if l.Aggregate != "" {
+		ret = ret + l.Aggregate + "{"
+	}
 	ret = ret + l.Predicate
 	if len(l.Terms) > 0 {
 		ret = ret + "("
 		termStrings := make([]string, len(l.Terms))
 		for i, t := range l.Terms {
 			if t.IsConstant {
-				termStrings[i] = fmt.Sprintf("c%v", t.Value)
+				switch t.Kind {
+				case KindInt:
+					termStrings[i] = fmt.Sprintf("i%v", t.Value)
+				case KindFloat:
+					termStrings[i] = fmt.Sprintf("f%v", t.float())
+				default:
+					termStrings[i] = fmt.Sprintf("c%v", t.Value)
+				}
 			} else {
 				termStrings[i] = fmt.Sprintf("v%v", t.Value)
 			}
@@ -130,6 +334,9 @@ func (l Literal) String() string {
 		ret = ret + strings.Join(termStrings, ", ")
 		ret = ret + ")"
 	}
+	if l.Aggregate != "" {
+		ret = ret + "}"
+	}
 	return ret
 }
 
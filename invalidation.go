@@ -19,18 +19,22 @@ func (ir invalidationReport) merge(other invalidationReport) invalidationReport
 }
 
 // must be called while holding resultsMutex
-func (db *Database) mergeResults(sgl Literal, id uuid.UUID, results map[uuid.UUID]result) {
+func (db *Database) mergeResults(sgl Literal, id uuid.UUID, results map[uuid.UUID]result, alternatives map[uuid.UUID][]proof) {
 	if _, ok := db.results[id]; ok {
 		// results already exist, continue
 		return
 	} else {
 		db.results[id] = make([]result, 0)
+		db.cachedSubgoals[id] = sgl
 	}
 	for _, r := range results {
 		db.results[id] = append(db.results[id], r)
 
 		db.proofs[r.Literal.id()] = append(db.proofs[r.Literal.id()], r.proof)
 	}
+	for lid, ps := range alternatives {
+		db.proofs[lid] = append(db.proofs[lid], ps...)
+	}
 }
 
 func (db *Database) recordInvalidations(subgoal Literal, id uuid.UUID, invalidators map[uuid.UUID]Literal) {
@@ -75,10 +79,52 @@ func (db *Database) invalidateLiteral(l Literal) invalidationReport {
 		}
 	}
 	delete(db.results, subgoalHash(l))
+	delete(db.cachedSubgoals, subgoalHash(l))
+
+	return ir
+}
+
+// invalidateHead clears every cached subgoal that a clause with the given head could
+// contribute results to, along with everything derived from those subgoals.
+func (db *Database) invalidateHead(head Literal) invalidationReport {
+	trace("Invalidating head", head)
+	ir := invalidationReport{}
 
+	db.resultsMutex.Lock()
+	defer db.resultsMutex.Unlock()
+
+	for id, i := range db.invalidations {
+		if unifiesApart(i.subgoal, head) {
+			ir = ir.merge(db.invalidate(id))
+		}
+	}
+	for id, l := range db.cachedSubgoals {
+		if unifiesApart(l, head) {
+			ir = ir.merge(db.invalidate(id))
+		}
+	}
 	return ir
 }
 
+// unifiesApart reports whether a and b unify once their variables have been renamed so
+// that they cannot collide. Stored clauses and cached subgoals draw variable names from
+// overlapping ranges, so they must be separated before unifying.
+func unifiesApart(a Literal, b Literal) bool {
+	counter := int64(0)
+	for _, l := range []Literal{a, b} {
+		for _, t := range l.Terms {
+			if !t.IsConstant && t.Value < counter {
+				counter = t.Value
+			}
+		}
+	}
+	freshEnv := emptyEnvironment()
+	b = freshenIn(b, &counter, &freshEnv)
+
+	match := emptyEnvironment()
+	return unify(a, b, &match)
+}
+
 func (db *Database) invalidate(subgoalID uuid.UUID) invalidationReport {
 	toInvalidate := []uuid.UUID{subgoalID}
 	ir := invalidationReport{}
@@ -93,6 +139,17 @@ func (db *Database) invalidate(subgoalID uuid.UUID) invalidationReport {
 			toInvalidate = append(toInvalidate, invalidation.dependentSubgoals...)
 		}
 		delete(db.invalidations, id)
+		// Subgoals that depend on this one are recorded against the ids of its literal,
+		// and of the negated literal for rules that used it negatively.
+		if l, ok := db.cachedSubgoals[id]; ok {
+			for _, lid := range []uuid.UUID{l.id(), Negate(l).id()} {
+				if invalidation, ok := db.invalidations[lid]; ok {
+					toInvalidate = append(toInvalidate, invalidation.dependentSubgoals...)
+				}
+				delete(db.invalidations, lid)
+			}
+			delete(db.cachedSubgoals, id)
+		}
 		if rs, ok := db.results[id]; ok {
 			ir.countResultsCleared++
 			for _, r := range rs {
@@ -129,3 +129,69 @@ func TestFailureInvalidations(t *testing.T) {
 	}
 
 }
+
+func TestRetractInvalidations(t *testing.T) {
+	db := dbFromString(t, `
+foo(a, b).
+foo(b, c).
+bar(X, Y) :- foo(X, Y).
+`)
+	r, err := db.Apply(db.ParseCommandOrPanic("bar(X, Y)?"))
+	if err != nil {
+		t.Error(err)
+	}
+	if len(r) != 2 {
+		t.Error("Expected 2 results, got", len(r))
+	}
+
+	_, err = db.Apply(db.ParseCommandOrPanic("foo(a, b)~"))
+	if err != nil {
+		t.Error(err)
+	}
+	if len(db.results) != 0 {
+		t.Error("Expected 0 results after retraction, got", len(db.results))
+	}
+
+	r, err = db.Apply(db.ParseCommandOrPanic("bar(X, Y)?"))
+	if err != nil {
+		t.Error(err)
+	}
+	compareDatalogResult(t, db.ToString(r), `bar(b, c).
+`)
+}
+
+func TestAssertInvalidations(t *testing.T) {
+	db := dbFromString(t, `
+foo(a, b).
+bar(X, Y) :- foo(X, Y).
+baz(X) :- foo(X, b), !bar(X, c).
+`)
+	r, err := db.Apply(db.ParseCommandOrPanic("baz(X)?"))
+	if err != nil {
+		t.Error(err)
+	}
+	compareDatalogResult(t, db.ToString(r), `baz(a).
+`)
+
+	// foo(a, c) makes bar(a, c) true, which must block baz(a).
+	_, err = db.Apply(db.ParseCommandOrPanic("foo(a, c)."))
+	if err != nil {
+		t.Error(err)
+	}
+
+	r, err = db.Apply(db.ParseCommandOrPanic("bar(X, Y)?"))
+	if err != nil {
+		t.Error(err)
+	}
+	compareDatalogResult(t, db.ToString(r), `bar(a, b).
+bar(a, c).
+`)
+
+	r, err = db.Apply(db.ParseCommandOrPanic("baz(X)?"))
+	if err != nil {
+		t.Error(err)
+	}
+	if len(r) != 0 {
+		t.Error("Expected 0 results after assert, got", db.ToString(r))
+	}
+}
@@ -4,6 +4,10 @@ import "fmt"
 
 var LogTrace = false
 
+// GoalGraphHook, if set, recieves a Graphviz DOT rendering of each goal's subgoals and chains
+// once the goal has been searched, whether or not the search succeeded.
+var GoalGraphHook func(dot string)
+
 func trace(args ...interface{}) {
 	if LogTrace {
 		fmt.Println(args...)
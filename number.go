@@ -0,0 +1,103 @@
+package authalog
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+func intTerm(i int64) Term {
+	return Term{IsConstant: true, Kind: KindInt, Value: i}
+}
+
+func floatTerm(f float64) Term {
+	return Term{IsConstant: true, Kind: KindFloat, Value: int64(math.Float64bits(f))}
+}
+
+func (t Term) isNumber() bool {
+	return t.IsConstant && (t.Kind == KindInt || t.Kind == KindFloat)
+}
+
+// float returns the value of a numeric term as a float64.
+func (t Term) float() float64 {
+	if t.Kind == KindFloat {
+		return math.Float64frombits(uint64(t.Value))
+	}
+	return float64(t.Value)
+}
+
+// parseNumber converts unquoted source text to a numeric term. Integers are written as an
+// optional '-' followed by digits, and floats additionally have a fractional part, as in
+// -2.5. Only canonical numerals, which formatNumber writes back as the same text, are numbers:
+// text like 2abc, 007, 1.50 or -0 is left to be interned as an atom, so that it is not changed
+// by being read.
+func parseNumber(str string) (Term, bool) {
+	if str == "" || (str[0] != '-' && !isNumber(rune(str[0]))) {
+		return Term{}, false
+	}
+	n, ok := Term{}, false
+	if i, err := strconv.ParseInt(str, 10, 64); err == nil {
+		n, ok = intTerm(i), true
+	} else if strings.ContainsRune(str, '.') {
+		if f, err := strconv.ParseFloat(str, 64); err == nil {
+			n, ok = floatTerm(f), true
+		}
+	}
+	if !ok || formatNumber(n) != str || (str[0] == '-' && n.float() == 0) {
+		return Term{}, false
+	}
+	return n, true
+}
+
+// formatNumber writes a numeric term so that parseNumber reads it back as the same kind.
+func formatNumber(t Term) string {
+	if t.Kind == KindInt {
+		return strconv.FormatInt(t.Value, 10)
+	}
+	str := strconv.FormatFloat(t.float(), 'f', -1, 64)
+	if !strings.ContainsRune(str, '.') {
+		str += ".0"
+	}
+	return str
+}
+
+// numberTerm converts Go's built in numeric types to numeric terms. Named types, such as
+// enums with a String method, are not converted.
+func numberTerm(v interface{}) (Term, bool) {
+	switch n := v.(type) {
+	case int:
+		return intTerm(int64(n)), true
+	case int8:
+		return intTerm(int64(n)), true
+	case int16:
+		return intTerm(int64(n)), true
+	case int32:
+		return intTerm(int64(n)), true
+	case int64:
+		return intTerm(n), true
+	case uint:
+		return intTerm(int64(n)), true
+	case uint8:
+		return intTerm(int64(n)), true
+	case uint16:
+		return intTerm(int64(n)), true
+	case uint32:
+		return intTerm(int64(n)), true
+	case uint64:
+		return intTerm(int64(n)), true
+	case float32:
+		return floatTerm(float64(n)), true
+	case float64:
+		return floatTerm(n), true
+	}
+	return Term{}, false
+}
+
+// constantString returns the text of a constant term: the string an atom was interned from,
+// or the number's decimal form.
+func constantString(in interner, t Term) string {
+	if t.isNumber() {
+		return formatNumber(t)
+	}
+	return in.lookup(t.Value)
+}
@@ -4,18 +4,99 @@ import (
 	"bufio"
 	"fmt"
 	"io"
-	"sort"
 	"strings"
 	"unicode/utf8"
 )
 
 type scanner struct {
-	r  *bufio.Reader
-	db *Database
+	r   *bufio.Reader
+	db  *Database
+	pos *scanPosition
 }
 
-func newScanner(input io.Reader, db *Database) scanner {
-	return scanner{bufio.NewReader(input), db}
+// scanPosition tracks where the scanner is in its input.
+type scanPosition struct {
+	// The position of the next rune to be read
+	next Position
+	// The position of the most recently read rune
+	last Position
+}
+
+func newScanner(input io.Reader, filename string, db *Database) scanner {
+	start := Position{Filename: filename, Line: 1, Column: 1}
+	return scanner{bufio.NewReader(input), db, &scanPosition{start, start}}
+}
+
+// Position is a location in datalog source text.
+type Position struct {
+	Filename string
+	Line     int // starting at 1
+	Column   int // starting at 1, counted in runes
+}
+
+// IsValid reports whether the position is known. Clauses constructed in Go, rather than
+// parsed, have no position.
+func (p Position) IsValid() bool {
+	return p.Line > 0
+}
+
+func (p Position) String() string {
+	str := p.Filename
+	if p.IsValid() {
+		if str != "" {
+			str += ":"
+		}
+		str += fmt.Sprintf("%d:%d", p.Line, p.Column)
+	}
+	if str == "" {
+		str = "-"
+	}
+	return str
+}
+
+// Span is the range of source text that a command or clause was parsed from. End is the
+// position just past the command's terminal.
+type Span struct {
+	Start Position
+	End   Position
+}
+
+// ParseError is an error in datalog source text.
+type ParseError struct {
+	Pos Position
+	Msg string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Pos, e.Msg)
+}
+
+func (s scanner) readRune() (rune, int, error) {
+	ch, size, err := s.r.ReadRune()
+	if err != nil {
+		return ch, size, err
+	}
+	s.pos.last = s.pos.next
+	if ch == '\n' {
+		s.pos.next.Line++
+		s.pos.next.Column = 1
+	} else {
+		s.pos.next.Column++
+	}
+	return ch, size, err
+}
+
+func (s scanner) unreadRune() error {
+	err := s.r.UnreadRune()
+	if err == nil {
+		s.pos.next = s.pos.last
+	}
+	return err
+}
+
+// errorf reports an error at the most recently read rune.
+func (s scanner) errorf(format string, args ...interface{}) error {
+	return &ParseError{Pos: s.pos.last, Msg: fmt.Sprintf(format, args...)}
 }
 
 func isWhitespace(ch rune) bool {
@@ -38,8 +119,8 @@ func isLetter(ch rune) bool {
 	return isLowerCase(ch) || isUpperCase(ch)
 }
 
-func isSingleQuote(ch rune) bool {
-	return ch == '\''
+func isQuote(ch rune) bool {
+	return ch == '\'' || ch == '"'
 }
 
 func isTerminal(ch rune) bool {
@@ -68,33 +149,44 @@ func isAllowedBodyRune(ch rune) bool {
 var eof = rune(0)
 
 func (s scanner) mustConsume(r rune) error {
-	ch, _, err := s.r.ReadRune()
+	ch, _, err := s.readRune()
 	if err != nil {
 		return err
 	}
 	if ch != r {
-		return fmt.Errorf("Expected %v, but got %v", string(r), string(ch))
+		return s.errorf("Expected %v, but got %v", string(r), string(ch))
 	}
 	return nil
 }
 
 func (s scanner) consumeRestOfLine() {
 	for {
-		ch, _, err := s.r.ReadRune()
+		ch, _, err := s.readRune()
 		if err != nil || ch == '\n' {
 			break
 		}
 	}
 }
 
+// consumeSpaces is like consumeWhitespace, but does not skip comments.
+func (s scanner) consumeSpaces() {
+	for {
+		ch, _, err := s.readRune()
+		if err != nil || !isWhitespace(ch) {
+			s.unreadRune()
+			return
+		}
+	}
+}
+
 func (s scanner) consumeWhitespace() {
 	for {
-		ch, _, err := s.r.ReadRune()
+		ch, _, err := s.readRune()
 		if err != nil || !isWhitespace(ch) {
 			if ch == '%' {
 				s.consumeRestOfLine()
 			} else {
-				s.r.UnreadRune()
+				s.unreadRune()
 				return
 			}
 		}
@@ -102,24 +194,111 @@ func (s scanner) consumeWhitespace() {
 }
 
 func (s scanner) scanIdentifier() (str string, isAtom bool, err error) {
+	return s.scanName(isAllowedBodyRune)
+}
+
+// scanOperand is like scanIdentifier, but stops before any '-', which follows the first operand
+// of an arithmetic expression like A-1 as its operator rather than as part of its name.
+func (s scanner) scanOperand() (str string, isAtom bool, err error) {
+	return s.scanName(func(ch rune) bool { return ch != '-' && isAllowedBodyRune(ch) })
+}
+
+// scanName scans a number, quoted atom, or name, whose runes after the first are those that
+// allowed accepts.
+func (s scanner) scanName(allowed func(rune) bool) (str string, isAtom bool, err error) {
 	s.consumeWhitespace()
-	ch, _, err := s.r.ReadRune()
-	if !isLetter(ch) && !isNumber(ch) && !isSingleQuote(ch) {
-		return str, false, fmt.Errorf("Expected a term startign with a letter or number, but got %v", string(ch))
+	ch, _, err := s.readRune()
+	if ch == '-' || isNumber(ch) {
+		return s.scanNumber(ch, allowed)
 	}
-	if !isSingleQuote(ch) {
-		str = str + string(ch)
-	} else {
-		isAtom = true
+	if isQuote(ch) {
+		str, err = s.scanQuoted(ch)
+		return str, true, err
 	}
-	for {
-		ch, _, err = s.r.ReadRune()
+	if !isLetter(ch) {
+		return str, false, s.errorf("Expected a term startign with a letter or number, but got %v", string(ch))
+	}
+	return s.scanIdentifierBody(string(ch), allowed)
+}
 
-		if !isAllowedBodyRune(ch) {
-			if !isSingleQuote(ch) {
-				s.r.UnreadRune()
+// quoteEscapes maps the runes that may follow a backslash in a quoted atom to the runes they
+// stand for.
+var quoteEscapes = map[rune]rune{
+	'\\': '\\',
+	'\'': '\'',
+	'"':  '"',
+	'n':  '\n',
+	't':  '\t',
+}
+
+// scanQuoted scans the rest of an atom opened by the quote rune, which may be ' or ". Quoted
+// atoms may hold any characters; backslashes escape the closing quote, backslashes
+// themselves, and newlines and tabs as \n and \t.
+func (s scanner) scanQuoted(quote rune) (string, error) {
+	var buf strings.Builder
+	for {
+		ch, _, err := s.readRune()
+		if err == io.EOF {
+			return buf.String(), s.errorf("Expected %v to close a quoted atom, but reached the end of input", string(quote))
+		}
+		if err != nil {
+			return buf.String(), err
+		}
+		if ch == quote {
+			return buf.String(), nil
+		}
+		if ch == '\\' {
+			ch, _, err = s.readRune()
+			if err != nil {
+				return buf.String(), err
 			}
-			return
+			escaped, ok := quoteEscapes[ch]
+			if !ok {
+				return buf.String(), s.errorf("Unknown escape sequence \\%v in a quoted atom", string(ch))
+			}
+			ch = escaped
+		}
+		buf.WriteRune(ch)
+	}
+}
+
+// scanNumber scans an optionally negative number, with an optional fractional part. Numbers
+// followed by identifier runes are scanned as identifiers instead, as in 2abc.
+func (s scanner) scanNumber(leading rune, allowed func(rune) bool) (str string, isAtom bool, err error) {
+	str = string(leading)
+	fractional := false
+	for {
+		next, _ := s.r.Peek(2)
+		if len(next) > 0 && isNumber(rune(next[0])) {
+			s.readRune()
+			str = str + string(next[0])
+			continue
+		}
+		// A '.' is only part of the number if a digit follows it; otherwise it ends a clause
+		if !fractional && len(next) > 1 && next[0] == '.' && isNumber(rune(next[1])) {
+			s.readRune()
+			str = str + "."
+			fractional = true
+			continue
+		}
+		break
+	}
+	if str == "-" {
+		return str, false, s.errorf("Expected a digit after '-'")
+	}
+	if next, _ := s.r.Peek(1); !fractional && len(next) > 0 && allowed(rune(next[0])) {
+		return s.scanIdentifierBody(str, allowed)
+	}
+	return str, false, nil
+}
+
+func (s scanner) scanIdentifierBody(str string, allowed func(rune) bool) (string, bool, error) {
+	for {
+		ch, _, err := s.readRune()
+
+		if !allowed(ch) {
+			s.unreadRune()
+			return str, false, err
 		}
 		str = str + string(ch)
 	}
@@ -170,6 +349,11 @@ func (s scanner) scanTerm() (t Term, err error) {
 }
 
 func (s scanner) makeTerm(id string, isAtom bool) (t Term) {
+	if !isAtom {
+		if n, ok := parseNumber(id); ok {
+			return n
+		}
+	}
 	leading, _ := utf8.DecodeRuneInString(id)
 
 	t.Value = s.db.intern(id)
@@ -196,17 +380,17 @@ func (s scanner) scanInSet(negated bool, leading string, isAtom bool) (lit Liter
 	}
 	var r rune
 	var t Term
-	vals := []int64{}
+	vals := []Term{}
 	for {
 		s.consumeWhitespace()
-		r, _, err = s.r.ReadRune()
+		r, _, err = s.readRune()
 		if err != nil {
 			return
 		}
 		if r == ']' {
 			break
 		} else {
-			err = s.r.UnreadRune()
+			err = s.unreadRune()
 			if err != nil {
 				return
 			}
@@ -217,27 +401,27 @@ func (s scanner) scanInSet(negated bool, leading string, isAtom bool) (lit Liter
 			return
 		}
 		if !t.IsConstant {
-			return lit, fmt.Errorf("Only constant terms allowed in sets, got: %v", s.db.lookup(t.Value))
+			return lit, s.errorf("Only constant terms allowed in sets, got: %v", s.db.lookup(t.Value))
 		}
-		vals = append(vals, t.Value)
+		vals = append(vals, t)
 
 		s.consumeWhitespace()
 		// Consume an optional comma
 		// TODO make commas non optional?
 
-		r, _, err = s.r.ReadRune()
+		r, _, err = s.readRune()
 		if err != nil {
 			return
 		}
 		if r != ',' {
-			err = s.r.UnreadRune()
+			err = s.unreadRune()
 			if err != nil {
 				return
 			}
 		}
 	}
 
-	sort.Slice(vals, func(i, j int) bool { return vals[i] < vals[j] })
+	sortTerms(vals)
 	sVal := s.db.storeSet(groundSet{vals})
 
 	// Reconstitute a literal
@@ -253,9 +437,121 @@ func (s scanner) scanInSet(negated bool, leading string, isAtom bool) (lit Liter
 	return lit, nil
 }
 
+// scanComparison scans the operator and right hand side of an infix comparison, whose left
+// hand side has already been scanned.
+func (s scanner) scanComparison(negated bool, leading string, isAtom bool) (lit Literal, err error) {
+	ch, _, err := s.readRune()
+	if err != nil {
+		return
+	}
+	operator := string(ch)
+	ch, _, err = s.readRune()
+	if err != nil {
+		return
+	}
+	if ch == '=' {
+		operator += "="
+	} else {
+		s.unreadRune()
+	}
+
+	for predicate, o := range comparisonOperators {
+		if o == operator {
+			lit.Predicate = predicate
+		}
+	}
+	if lit.Predicate == "" {
+		return lit, s.errorf("Unknown comparison operator %v", operator)
+	}
+
+	right, err := s.scanTerm()
+	if err != nil {
+		return
+	}
+	lit.Negated = negated
+	lit.Terms = []Term{s.makeTerm(leading, isAtom), right}
+	return lit, nil
+}
+
+// scanArithmetic scans the '=' and operation of an arithmetic literal, or the '=' and
+// aggregate of an aggregate literal, whose result has already been scanned.
+func (s scanner) scanArithmetic(negated bool, leading string, isAtom bool) (lit Literal, err error) {
+	err = s.mustConsume('=')
+	if err != nil {
+		return
+	}
+	name, nameIsAtom, err := s.scanOperand()
+	if err != nil {
+		return
+	}
+	// '%' would otherwise begin a comment
+	s.consumeSpaces()
+	ch, _, err := s.readRune()
+	if err != nil {
+		return
+	}
+	if ch == '{' && !nameIsAtom {
+		return s.scanAggregate(negated, name, s.makeTerm(leading, isAtom))
+	}
+	a := s.makeTerm(name, nameIsAtom)
+	for predicate, o := range arithmeticOperators {
+		if o == string(ch) {
+			lit.Predicate = predicate
+		}
+	}
+	if lit.Predicate == "" {
+		return lit, s.errorf("Expected an arithmetic operator, but got %v", string(ch))
+	}
+	b, err := s.scanTerm()
+	if err != nil {
+		return
+	}
+	lit.Negated = negated
+	lit.Terms = []Term{a, b, s.makeTerm(leading, isAtom)}
+	return lit, nil
+}
+
+// scanAggregate scans the body of an aggregate literal, like count{ G : member(U, G) }, whose
+// function and opening '{' have already been scanned.
+func (s scanner) scanAggregate(negated bool, function string, result Term) (lit Literal, err error) {
+	if _, ok := aggregateFunctions[function]; !ok {
+		return lit, s.errorf("Unknown aggregate function %v", function)
+	}
+	if negated {
+		return lit, s.errorf("Aggregates cannot be negated")
+	}
+	aggregated, err := s.scanTerm()
+	if err != nil {
+		return
+	}
+	s.consumeWhitespace()
+	err = s.mustConsume(':')
+	if err != nil {
+		return
+	}
+	s.consumeWhitespace()
+	over, err := s.scanLiteral()
+	if err != nil {
+		return
+	}
+	if over.Negated || over.isAggregate() {
+		return lit, s.errorf("Aggregates range over a single positive literal")
+	}
+	s.consumeWhitespace()
+	err = s.mustConsume('}')
+	if err != nil {
+		return
+	}
+	return Literal{
+		Predicate: over.Predicate,
+		Terms:     append([]Term{result, aggregated}, over.Terms...),
+		Aggregate: function,
+	}, nil
+}
+
 func (s scanner) scanLiteral() (lit Literal, err error) {
 	negated := false
-	leading, _, err := s.r.ReadRune()
+	leading, _, err := s.readRune()
 	if err != nil {
 		return
 	}
@@ -263,7 +559,7 @@ func (s scanner) scanLiteral() (lit Literal, err error) {
 		negated = true
 		s.consumeWhitespace()
 	} else {
-		s.r.UnreadRune()
+		s.unreadRune()
 	}
 
 	name, isAtom, err := s.scanIdentifier()
@@ -279,14 +575,22 @@ func (s scanner) scanLiteral() (lit Literal, err error) {
 
 	// We might have  a 0-arity Literal, so check if we have a period, and return if so.
 
-	ch, _, err := s.r.ReadRune()
+	ch, _, err := s.readRune()
 	if err != nil {
 		return lit, err
 	}
-	s.r.UnreadRune()
+	s.unreadRune()
 	if isTerminal(ch) {
 		return
 	}
+	// A comparison, like 'A < B'
+	if ch == '<' || ch == '>' || ch == '!' {
+		return s.scanComparison(negated, name, isAtom)
+	}
+	// Arithmetic, like 'C = A + B'
+	if ch == '=' {
+		return s.scanArithmetic(negated, name, isAtom)
+	}
 	// If it's a 'i', we are in a 'A in {}' expression
 	if ch == 'i' {
 		l, e := s.scanInSet(negated, name, isAtom)
@@ -298,7 +602,7 @@ func (s scanner) scanLiteral() (lit Literal, err error) {
 		return
 	}
 	// Check if its a zero-arity
-	ch, _, err = s.r.ReadRune()
+	ch, _, err = s.readRune()
 	if err != nil {
 		return lit, err
 	}
@@ -306,7 +610,7 @@ func (s scanner) scanLiteral() (lit Literal, err error) {
 	if ch == ')' {
 		return
 	}
-	s.r.UnreadRune()
+	s.unreadRune()
 	for {
 		s.consumeWhitespace()
 
@@ -318,7 +622,7 @@ func (s scanner) scanLiteral() (lit Literal, err error) {
 
 		s.consumeWhitespace()
 
-		ch, _, err := s.r.ReadRune()
+		ch, _, err := s.readRune()
 		if err != nil {
 			return lit, err
 		}
@@ -326,21 +630,28 @@ func (s scanner) scanLiteral() (lit Literal, err error) {
 		if ch == ')' {
 			break
 		}
-		s.r.UnreadRune()
-		s.mustConsume(',')
+		s.unreadRune()
+		err = s.mustConsume(',')
+		if err != nil {
+			return lit, err
+		}
 	}
 	return
 }
 
 func (s scanner) scanCommand() (cmd Command, err error) {
 	s.consumeWhitespace()
+	cmd.Span.Start = s.pos.next
+	defer func() {
+		cmd.Span.End = s.pos.next
+	}()
 	cmd.Head, err = s.scanLiteral()
 	if err != nil {
 		return
 	}
 
 	s.consumeWhitespace()
-	ch, _, err := s.r.ReadRune()
+	ch, _, err := s.readRune()
 	if err != nil {
 		return cmd, err
 	}
@@ -349,8 +660,12 @@ func (s scanner) scanCommand() (cmd Command, err error) {
 		cmd.CommandType = commandForTerminal(ch)
 		return
 	}
+	if ch == ',' {
+		err = s.scanConjunctiveQuery(&cmd)
+		return
+	}
 
-	s.r.UnreadRune()
+	s.unreadRune()
 	err = s.mustConsume(':')
 	if err != nil {
 		return
@@ -372,52 +687,150 @@ func (s scanner) scanCommand() (cmd Command, err error) {
 		s.consumeWhitespace()
 
 		// Check for terminus
-		ch, _, err = s.r.ReadRune()
+		ch, _, err = s.readRune()
 		if err != nil {
 			return
 		}
-		if ch == '.' {
+		if ch == '.' || ch == '~' {
+			cmd.CommandType = commandForTerminal(ch)
 			return
 		}
 		if ch == ',' {
 			continue
 		}
-		err = fmt.Errorf("Expected '.' or ',', but got %v", string(ch))
+		err = s.errorf("Expected '.', '~' or ',', but got %v", string(ch))
 		return
 	}
 }
 
+// scanConjunctiveQuery scans the literals that follow the first of a query like a(X), b(X)?
+// into cmd's body.
+func (s scanner) scanConjunctiveQuery(cmd *Command) error {
+	for {
+		s.consumeWhitespace()
+		l, err := s.scanLiteral()
+		if err != nil {
+			return err
+		}
+		cmd.Body = append(cmd.Body, l)
+
+		s.consumeWhitespace()
+		ch, _, err := s.readRune()
+		if err != nil {
+			return err
+		}
+		if ch == '?' {
+			cmd.CommandType = CommandQuery
+			return nil
+		}
+		if ch != ',' {
+			return s.errorf("Expected '?' or ',' in a conjunctive query, but got %v", string(ch))
+		}
+	}
+}
+
 func (s scanner) scanOneCommand() (Command, bool, error) {
 	s.consumeWhitespace()
-	ch, _, err := s.r.ReadRune()
+	ch, _, err := s.readRune()
 
 	if ch == eof || err != nil {
 		return Command{}, true, nil
 	}
-	s.r.UnreadRune()
+	s.unreadRune()
 
 	c, err := s.scanCommand()
+	if err == io.EOF {
+		err = &ParseError{Pos: s.pos.next, Msg: "unexpected end of input"}
+	} else if _, ok := err.(*ParseError); err != nil && !ok {
+		err = &ParseError{Pos: s.pos.next, Msg: err.Error()}
+	}
 	return c, false, err
 }
 
 func (db *Database) termString(t Term) string {
-	if interned, ok := db.internedLookup[t.Value]; ok {
-		leading, _ := utf8.DecodeRuneInString(interned)
-		if isUpperCase(leading) {
-			// TODO: if we start with a number or a lowercase letter, we don't need quotes
-			return "'" + interned + "'"
-		} else {
-			return interned
+	if !t.IsConstant {
+		// Variables introduced by renaming, and don't cares, have no useful name of their own
+		if name, ok := db.internedLookup[t.Value]; ok && name != "_" {
+			return name
+		}
+		if t.Value < 0 {
+			return fmt.Sprintf("_G%v", -t.Value)
 		}
+		return fmt.Sprintf("_%v", t.Value)
+	}
+	if t.isNumber() {
+		return formatNumber(t)
+	}
+	if interned, ok := db.internedLookup[t.Value]; ok {
+		return quoteAtom(interned)
 	}
 	return fmt.Sprintf("Unknown:%v", t.Value)
 }
 
+// quoteAtom quotes str unless it would be read back as the same atom without quotes: unless it
+// holds only letters, numbers, '_' and '-', and starts with a lower case letter or with a digit
+// without being a number.
+func quoteAtom(str string) string {
+	leading, _ := utf8.DecodeRuneInString(str)
+	_, number := parseNumber(str)
+	bare := isLowerCase(leading) || (isNumber(leading) && !number)
+	for _, ch := range str {
+		bare = bare && isAllowedBodyRune(ch)
+	}
+	if bare {
+		return str
+	}
+	var buf strings.Builder
+	buf.WriteRune('\'')
+	for _, ch := range str {
+		switch ch {
+		case '\\', '\'':
+			buf.WriteRune('\\')
+			buf.WriteRune(ch)
+		case '\n':
+			buf.WriteString("\\n")
+		case '\t':
+			buf.WriteString("\\t")
+		default:
+			buf.WriteRune(ch)
+		}
+	}
+	buf.WriteRune('\'')
+	return buf.String()
+}
+
 // Should we instead write commands back to disk,
 // and focus on providing utility methods to convert Clauses back to commands?
 // TODO:consider this.
 func (db *Database) writeLiteral(w io.Writer, l *Literal) error {
-	_, err := io.WriteString(w, l.Predicate)
+	if l.Negated {
+		_, err := io.WriteString(w, "!")
+		if err != nil {
+			return err
+		}
+	}
+	if l.isAggregate() {
+		over := l.aggregated()
+		_, err := fmt.Fprintf(w, "%v = %v{ %v : ", db.termString(l.Terms[0]), l.Aggregate, db.termString(l.Terms[1]))
+		if err != nil {
+			return err
+		}
+		err = db.writeLiteral(w, &over)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, " }")
+		return err
+	}
+	if operator, ok := comparisonOperators[l.Predicate]; ok && isComparison(*l) {
+		_, err := fmt.Fprintf(w, "%v %v %v", db.termString(l.Terms[0]), operator, db.termString(l.Terms[1]))
+		return err
+	}
+	if operator, ok := arithmeticOperators[l.Predicate]; ok && isArithmetic(*l) {
+		_, err := fmt.Fprintf(w, "%v = %v %v %v", db.termString(l.Terms[2]), db.termString(l.Terms[0]), operator, db.termString(l.Terms[1]))
+		return err
+	}
+	_, err := io.WriteString(w, quoteAtom(l.Predicate))
 	if err != nil {
 		return err
 	}
@@ -449,7 +862,12 @@ func (db *Database) writeClause(w io.Writer, c *Clause, t CommandType) error {
 		return err
 	}
 	if len(c.Body) > 0 {
-		_, err := io.WriteString(w, " :- ")
+		// The body of a query is conjoined with its head
+		separator := " :- "
+		if t == CommandQuery {
+			separator = ", "
+		}
+		_, err := io.WriteString(w, separator)
 		for i, l := range c.Body {
 			if i > 0 {
 				_, err := io.WriteString(w, ", ")
@@ -489,9 +907,11 @@ func C(head Literal, body ...Literal) Clause {
 	}
 }
 
-func Ask(l Literal) Command {
+// Ask returns a command querying l, conjoined with any further literals.
+func Ask(l Literal, and ...Literal) Command {
 	return Command{
 		Head:        l,
+		Body:        and,
 		CommandType: CommandQuery,
 	}
 }
@@ -503,6 +923,13 @@ func Assert(l Literal) Command {
 	}
 }
 
+func Retract(l Literal) Command {
+	return Command{
+		Head:        l,
+		CommandType: CommandRetract,
+	}
+}
+
 func Negate(l Literal) Literal {
 	l.Negated = true
 	return l
@@ -516,6 +943,9 @@ func (db *Database) termFromInterface(t interface{}) Term {
 			Value:      db.intern(t.(vardef).name),
 		}
 	default:
+		if n, ok := numberTerm(t); ok {
+			return n
+		}
 		return Term{
 			IsConstant: true,
 			Value:      db.intern(fmt.Sprint(t)),
@@ -525,7 +955,7 @@ func (db *Database) termFromInterface(t interface{}) Term {
 
 func (db *Database) InSet(item interface{}, set ...interface{}) Literal {
 
-	vals := []int64{}
+	vals := []Term{}
 
 	for _, s := range set {
 		st := db.termFromInterface(s)
@@ -533,10 +963,10 @@ func (db *Database) InSet(item interface{}, set ...interface{}) Literal {
 			// TODO: is there a better way?
 			panic("Only pass constant terms to InSet's set")
 		}
-		vals = append(vals, st.Value)
+		vals = append(vals, st)
 	}
 
-	sort.Slice(vals, func(i, j int) bool { return vals[i] < vals[j] })
+	sortTerms(vals)
 	sVal := db.storeSet(groundSet{vals})
 
 	return Literal{
@@ -2,7 +2,9 @@ package authalog
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"strings"
 
 	uuid "github.com/satori/go.uuid"
 )
@@ -14,14 +16,23 @@ func (db *Database) ProofOf(l Literal) ([]proof, bool) {
 	return ps, ok
 }
 
+// ProofString writes the derivation of l, and of each of its premises. Literals without a
+// recorded proof, because they have not been asked or do not hold, are written as a comment
+// saying so; WhyNot explains literals that do not hold.
 func (db *Database) ProofString(l Literal) string {
+	return db.proofString([]Literal{l})
+}
+
+// proofString writes the derivations of each of ls, and of their premises, writing each
+// literal's derivation once.
+func (db *Database) proofString(ls []Literal) string {
 	result := bytes.NewBufferString("")
 
 	prooved := map[uuid.UUID]struct{}{}
-	toProove := []Literal{l}
+	toProove := append([]Literal{}, ls...)
 
 	for len(toProove) > 0 {
-		l = toProove[0]
+		l := toProove[0]
 		toProove = toProove[1:]
 		id := l.id()
 		if _, ok := prooved[id]; ok {
@@ -31,27 +42,217 @@ func (db *Database) ProofString(l Literal) string {
 		}
 
 		ps, ok := db.ProofOf(l)
-		if !ok {
-			panic(fmt.Sprint("Something went wrong, could not find proof for", l))
+		if !ok || len(ps) == 0 {
+			result.WriteString("% No proof of ")
+			db.writeLiteral(result, &l)
+			result.WriteString(" has been recorded. Ask for it first, or see WhyNot.\n")
+			continue
 		}
 		// Work with the first proof, and only the first proof
 		p := ps[0]
 
-		// If the fact came from an external relation.
-		// TODO: better way to signal this?
-		if p.Clause == uuid.Nil {
+		if p.external != nil {
 			db.writeLiteral(result, &l)
-			result.WriteString(". % From idb\n")
+			result.WriteString(". % From " + db.originString(*p.external) + "\n")
 			continue
 		}
 
 		c := db.clauses[p.Clause]
 		substituted := p.substitutions.rewriteClause(c)
 		db.writeClause(result, &substituted, CommandAssert)
-		if len(substituted.Body) > 0 {
-			toProove = append(substituted.Body, toProove...)
+		// Negated literals hold because they have no proof, and aggregates because of the
+		// answers they aggregate
+		premises := []Literal{}
+		for _, b := range substituted.Body {
+			if !b.Negated && !b.isAggregate() {
+				premises = append(premises, b)
+			}
 		}
+		toProove = append(premises, toProove...)
 	}
 
 	return result.String()
 }
+
+// ProofTree is every derivation of a ground literal that the database has recorded.
+type ProofTree struct {
+	Literal Literal
+	// Each derivation is an alternative proof of Literal.
+	Derivations []Derivation
+
+	db *Database
+}
+
+// Derivation is a single step in a proof: a clause whose head, once substituted, is the proven
+// literal, along with the proofs of its body.
+type Derivation struct {
+	// The clause used, with its variables substituted. Empty for external derivations.
+	Clause Clause
+	// External is set when the literal was provided by an external relation rather than a
+	// clause, and Origin describes the call that provided it.
+	External bool
+	Origin   *ExternalOrigin
+	// Premises proves each positive literal in the clause's body, in order.
+	Premises []*ProofTree
+	// Absent lists the clause's negated body literals, which held because their positive forms
+	// could not be proven.
+	Absent []Literal
+	// Aggregates lists the clause's aggregate literals, with their results.
+	Aggregates []Literal
+}
+
+// ProofTree returns all recorded derivations of l, and recursively of their premises. As with
+// ProofOf, l must have been asked directly or returned from a previous ask of the database.
+// Derivations that would depend on the literal they prove are omitted.
+func (db *Database) ProofTree(l Literal) (*ProofTree, error) {
+	db.resultsMutex.RLock()
+	defer db.resultsMutex.RUnlock()
+	db.clauseMutex.RLock()
+	defer db.clauseMutex.RUnlock()
+
+	if _, ok := db.proofs[l.id()]; !ok {
+		return nil, fmt.Errorf("no proof of %v", db.literalString(l))
+	}
+	return db.proofTree(l, map[uuid.UUID]struct{}{}), nil
+}
+
+// must be called while holding resultsMutex and clauseMutex
+func (db *Database) proofTree(l Literal, ancestors map[uuid.UUID]struct{}) *ProofTree {
+	id := l.id()
+	ancestors[id] = struct{}{}
+	defer delete(ancestors, id)
+
+	t := &ProofTree{
+		Literal: l,
+		db:      db,
+	}
+	seen := map[string]struct{}{}
+	for _, p := range db.proofs[id] {
+		if p.external != nil {
+			key := db.originString(*p.external)
+			if _, ok := seen[key]; !ok {
+				seen[key] = struct{}{}
+				t.Derivations = append(t.Derivations, Derivation{External: true, Origin: p.external})
+			}
+			continue
+		}
+		c, ok := db.clauses[p.Clause]
+		if !ok {
+			continue
+		}
+		d := Derivation{Clause: resolved(p.substitutions, c)}
+		// The same derivation is recorded once for every subgoal that produced it
+		key := d.Clause.String()
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+
+		cyclic := false
+		for _, b := range d.Clause.Body {
+			if b.Negated {
+				d.Absent = append(d.Absent, b)
+				continue
+			}
+			if b.isAggregate() {
+				d.Aggregates = append(d.Aggregates, b)
+				continue
+			}
+			if _, ok := ancestors[b.id()]; ok {
+				cyclic = true
+				break
+			}
+			d.Premises = append(d.Premises, db.proofTree(b, ancestors))
+		}
+		if !cyclic {
+			t.Derivations = append(t.Derivations, d)
+		}
+	}
+	return t
+}
+
+type proofTreeJSON struct {
+	Literal     string           `json:"literal"`
+	Derivations []derivationJSON `json:"derivations"`
+}
+
+type derivationJSON struct {
+	Clause     string       `json:"clause,omitempty"`
+	Position   string       `json:"position,omitempty"`
+	External   bool         `json:"external"`
+	Origin     *originJSON  `json:"origin,omitempty"`
+	Premises   []*ProofTree `json:"premises"`
+	Absent     []string     `json:"absent"`
+	Aggregates []string     `json:"aggregates,omitempty"`
+}
+
+type originJSON struct {
+	Relation string `json:"relation"`
+	Input    string `json:"input"`
+	Table    string `json:"table,omitempty"`
+	Query    string `json:"query,omitempty"`
+}
+
+// MarshalJSON renders literals and clauses as datalog text.
+func (t *ProofTree) MarshalJSON() ([]byte, error) {
+	j := proofTreeJSON{
+		Literal:     t.db.literalString(t.Literal),
+		Derivations: make([]derivationJSON, len(t.Derivations)),
+	}
+	for i, d := range t.Derivations {
+		dj := derivationJSON{
+			External: d.External,
+			Premises: d.Premises,
+			Absent:   make([]string, len(d.Absent)),
+		}
+		if dj.Premises == nil {
+			dj.Premises = []*ProofTree{}
+		}
+		if !d.External {
+			dj.Clause = t.db.clauseString(d.Clause)
+		}
+		if d.Origin != nil {
+			dj.Origin = &originJSON{
+				Relation: d.Origin.Relation,
+				Input:    t.db.inputString(d.Origin.Input),
+				Table:    d.Origin.Table,
+				Query:    d.Origin.Query,
+			}
+		}
+		if d.Clause.Span.Start.IsValid() {
+			dj.Position = d.Clause.Span.Start.String()
+		}
+		for k, l := range d.Absent {
+			dj.Absent[k] = t.db.literalString(l)
+		}
+		for _, l := range d.Aggregates {
+			dj.Aggregates = append(dj.Aggregates, t.db.literalString(l))
+		}
+		j.Derivations[i] = dj
+	}
+	return json.Marshal(j)
+}
+
+// originString describes where an externally provided fact came from, eg
+// "external relation users(42, _), table users: SELECT id, role FROM users WHERE id = $1;"
+func (db *Database) originString(o ExternalOrigin) string {
+	str := "external relation " + db.inputString(o.Input)
+	if o.Table != "" {
+		str += fmt.Sprintf(", table %v: %v", o.Table, o.Query)
+	}
+	return str
+}
+
+// inputString writes the literal an external relation was called with, showing unbound
+// arguments as don't cares.
+func (db *Database) inputString(l Literal) string {
+	terms := make([]string, len(l.Terms))
+	for i, t := range l.Terms {
+		if t.IsConstant {
+			terms[i] = db.termString(t)
+		} else {
+			terms[i] = "_"
+		}
+	}
+	return fmt.Sprintf("%v(%v)", l.Predicate, strings.Join(terms, ", "))
+}
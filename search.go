@@ -1,6 +1,7 @@
 package authalog
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"sort"
@@ -10,6 +11,7 @@ import (
 )
 
 type goal struct {
+	ctx      context.Context
 	db       *Database
 	varCount int64 // Used to freshen/rename variables
 	l        Literal
@@ -21,6 +23,8 @@ type goal struct {
 	// with additional bindings being 'chained' together to accumulate results. They are initialized
 	// from rule bodies.
 	chains map[uuid.UUID]*chain
+	// Calls to batched external relations, waiting to be run together by flushExternal
+	pending map[batchKey]*pendingBatch
 }
 
 type chain struct {
@@ -43,6 +47,9 @@ type subgoal struct {
 	// the subgoal's literal. If the literal is negated
 	// TODO: consider a new structure that would allow
 	results map[uuid.UUID]result
+	// Alternative proofs of results, found after the result was first stored. Maps
+	// result literal id to proofs.
+	alternatives map[uuid.UUID][]proof
 	// The dependents of this subgoal (chains that depend on it)
 	dependents []dependent
 
@@ -191,14 +198,20 @@ func (g *goal) chain(clauseID uuid.UUID, env environment, body []Literal, additi
 		// Make sure we store positive forms only in validators
 		i := newBody[0]
 		i.Negated = false
-		c.invalidators[newBody[0].id()] = i
+		if i.isAggregate() {
+			// Aggregates are invalidated by the literal they range over
+			i = i.aggregated()
+			c.invalidators[i.id()] = i
+		} else {
+			c.invalidators[newBody[0].id()] = i
+		}
 		g.chains[id] = &c
 	}
 
 	return id, isNew, nil
 }
 
-func (g *goal) putSubgoal(l Literal, env environment, additionalDependents []dependent) (uuid.UUID, bool) {
+func (g *goal) putSubgoal(l Literal, env environment, additionalDependents []dependent) (uuid.UUID, bool, error) {
 	isNew := false
 	l = env.rewrite(l)
 	id := subgoalHash(l)
@@ -226,17 +239,21 @@ func (g *goal) putSubgoal(l Literal, env environment, additionalDependents []dep
 			// Or are there cases wherein we need to pull information from the original dependent's clausempapping? is it always empty?
 
 		}
-		g.addDependent(sg, newDependents)
+		err := g.addDependent(sg, newDependents)
+		if err != nil {
+			return id, isNew, err
+		}
 	} else {
 		isNew = true
 		g.subgoals[id] = &subgoal{
 			Literal:      l,
 			results:      map[uuid.UUID]result{},
+			alternatives: map[uuid.UUID][]proof{},
 			dependents:   additionalDependents,
 			invalidators: map[uuid.UUID]Literal{},
 		}
 	}
-	return id, isNew
+	return id, isNew, nil
 }
 
 type dependent struct {
@@ -384,7 +401,10 @@ func (g *goal) mergeResultIntoChain(chain *chain, r result) error {
 			if err != nil {
 				return err
 			}
-			g.mergeResultIntoSubgoal(g.subgoals[d.recieverID], dependentResult)
+			err = g.mergeResultIntoSubgoal(g.subgoals[d.recieverID], dependentResult)
+			if err != nil {
+				return err
+			}
 		}
 		return nil
 	}
@@ -407,7 +427,10 @@ func (g *goal) mergeResultIntoChain(chain *chain, r result) error {
 		}
 		chain.results[r.Literal.id()] = resultNext{result: r, next: next}
 		if isNew {
-			g.visitChain(next)
+			err = g.visitChain(next)
+			if err != nil {
+				return err
+			}
 		}
 	} else {
 		// Failure -- fire the dependents
@@ -447,6 +470,8 @@ func (g *goal) mergeResultIntoSubgoal(sg *subgoal, r result) error {
 				return err
 			}
 		}
+	} else {
+		sg.alternatives[r.Literal.id()] = append(sg.alternatives[r.Literal.id()], r.proof)
 	}
 	return nil
 }
@@ -461,7 +486,17 @@ func (l Literal) allConstant() bool {
 }
 
 func (g *goal) visitChain(chainId uuid.UUID) error {
+	if err := g.ctx.Err(); err != nil {
+		return err
+	}
 	chain := g.chains[chainId]
+	if chain.body[0].isAggregate() {
+		return g.visitAggregate(chainId)
+	}
+	err := g.pushDownJoin(chain)
+	if err != nil {
+		return err
+	}
 
 	// This violates an invariant of environments that is enforced when bind() is called --
 	// that we not map variables to themselves
@@ -474,9 +509,23 @@ func (g *goal) visitChain(chainId uuid.UUID) error {
 
 	subgoalTarget := chain.body[0]
 	subgoalTarget.Negated = false
-	id, isNew := g.putSubgoal(subgoalTarget, emptyEnvironment(), []dependent{dependent{chainId, cm}})
+	id, isNew, err := g.putSubgoal(subgoalTarget, emptyEnvironment(), []dependent{dependent{chainId, cm}})
+	if err != nil {
+		return err
+	}
 	if isNew {
-		g.visitSubgoal(id)
+		err = g.visitSubgoal(id)
+		if err != nil {
+			return err
+		}
+	}
+	if chain.body[0].Negated {
+		// A negated literal holds only if its positive form has no answers, which may still be
+		// waiting on batched external relations
+		err = g.flushExternal()
+		if err != nil {
+			return err
+		}
 	}
 	// If the leading literal is negated and we get here without accumulating any successful results,
 	// then signal
@@ -504,6 +553,9 @@ type rule struct {
 }
 
 func (g *goal) visitSubgoal(subgoal uuid.UUID) error {
+	if err := g.ctx.Err(); err != nil {
+		return err
+	}
 	sg := g.subgoals[subgoal]
 	trace("visiting", sg.Literal)
 	if sg.Literal.Negated {
@@ -518,6 +570,15 @@ func (g *goal) visitSubgoal(subgoal uuid.UUID) error {
 	if ok {
 		trace("Found results")
 		for _, r := range results {
+			// The cached environment binds the variables of the goal that produced it, which
+			// need not be the same as this subgoal's.
+			if !r.isFailure {
+				env := emptyEnvironment()
+				if !unify(r.Literal, sg.Literal, &env) {
+					continue
+				}
+				r.env = env
+			}
 			err := g.mergeResultIntoSubgoal(sg, r)
 			if err != nil {
 				return err
@@ -529,18 +590,20 @@ func (g *goal) visitSubgoal(subgoal uuid.UUID) error {
 	// Check external relations
 
 	external := []ExternalRelation{}
+	keys := []batchKey{}
 	g.db.clauseMutex.RLock()
-	for _, r := range g.db.externalRelations {
+	for i, r := range g.db.externalRelationsFor(sg.Literal) {
 		match := emptyEnvironment()
 		if ok := unify(sg.Literal, r.head, &match); ok {
 			external = append(external, r)
+			keys = append(keys, batchKey{predicateKey(sg.Literal), i})
 		}
 	}
 	g.db.clauseMutex.RUnlock()
 
-	for _, r := range external {
+	for i, r := range external {
 		trace("Matched external relation", r.head)
-		err := g.runExternalRule(sg, r)
+		err := g.runExternalRule(sg, r, keys[i])
 		if err != nil {
 			return err
 		}
@@ -551,7 +614,8 @@ func (g *goal) visitSubgoal(subgoal uuid.UUID) error {
 	// Check Clauses
 	g.db.clauseMutex.RLock()
 	match := emptyEnvironment()
-	for cid, c := range g.db.clauses {
+	for _, cid := range g.db.index.candidates(sg.Literal) {
+		c := g.db.clauses[cid]
 		match.reset()
 		// If it's a fact
 		if len(c.Body) == 0 {
@@ -622,3 +686,29 @@ func (g *goal) visitSubgoal(subgoal uuid.UUID) error {
 	}
 	return nil
 }
+
+// visitRule searches for the results of subgoal given by c alone, as visitSubgoal does for
+// each rule whose head matches a subgoal. c need not be stored in the database.
+func (g *goal) visitRule(subgoal uuid.UUID, c Clause) error {
+	sg := g.subgoals[subgoal]
+	freshEnv := emptyEnvironment()
+	fresh := g.freshenIn(sg.Literal, &freshEnv)
+	match := emptyEnvironment()
+	if !unify(fresh, c.Head, &match) {
+		return nil
+	}
+	freshEnv = rewritten(freshEnv, match)
+
+	cm := map[int64]Term{}
+	freshEnv.forEach(func(k int64, v Term) { cm[k] = v })
+	chainId, isNew, err := g.chain(
+		c.id(),
+		match,
+		c.Body,
+		[]dependent{dependent{subgoal, cm}},
+		map[uuid.UUID]Literal{})
+	if err != nil || !isNew {
+		return err
+	}
+	return g.visitChain(chainId)
+}
@@ -0,0 +1,485 @@
+package authalog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Snapshots are a little-endian binary encoding of a database's clauses, interning tables and
+// stored sets, optionally followed by its cache of derived results. External relations are not
+// saved; they must be added to a loaded database again before querying it.
+
+var snapshotMagic = [8]byte{'a', 'u', 't', 'h', 'a', 'l', 'o', 'g'}
+
+const snapshotVersion uint32 = 4
+
+const (
+	snapshotHasResults byte = 1 << iota
+)
+
+// Save writes a snapshot of the database's clauses, interned strings and sets to w.
+func (db *Database) Save(w io.Writer) error {
+	return db.save(w, false)
+}
+
+// SaveWithResults is like Save, but also writes the database's cache of derived results, so
+// that a database loaded from the snapshot can answer previously asked queries without
+// searching again.
+func (db *Database) SaveWithResults(w io.Writer) error {
+	return db.save(w, true)
+}
+
+// LoadDatabase reads a database from a snapshot written by Save or SaveWithResults.
+func LoadDatabase(r io.Reader) (*Database, error) {
+	db := NewDatabase()
+	sr := snapshotReader{r: bufio.NewReader(r)}
+
+	var magic [8]byte
+	sr.read(&magic)
+	if sr.err == nil && magic != snapshotMagic {
+		return nil, fmt.Errorf("not an authalog snapshot")
+	}
+	var version uint32
+	sr.read(&version)
+	if sr.err == nil && version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %v, expected %v", version, snapshotVersion)
+	}
+	var flags byte
+	sr.read(&flags)
+
+	// Interning
+	sr.read(&db.vars)
+	sr.read(&db.internCount)
+	for i, n := 0, sr.count(); i < n && sr.err == nil; i++ {
+		var v int64
+		sr.read(&v)
+		str := sr.string()
+		db.internedLookup[v] = str
+		if str != "_" {
+			db.interned[str] = v
+		}
+	}
+	for i, n := 0, sr.count(); i < n && sr.err == nil; i++ {
+		var v int64
+		sr.read(&v)
+		items := []Term{}
+		for j, m := 0, sr.count(); j < m && sr.err == nil; j++ {
+			items = append(items, sr.term())
+		}
+		db.setLookup[v] = groundSet{items}
+	}
+
+	// Clauses
+	for i, n := 0, sr.count(); i < n && sr.err == nil; i++ {
+		id := sr.id()
+		c := sr.clause()
+		if sr.err != nil {
+			break
+		}
+		err := db.addDependencies(c)
+		if err != nil {
+			return nil, err
+		}
+		db.addDefinition(c.Head)
+		db.storeClause(id, c)
+	}
+
+	if flags&snapshotHasResults != 0 {
+		for i, n := 0, sr.count(); i < n && sr.err == nil; i++ {
+			id := sr.id()
+			db.cachedSubgoals[id] = sr.literal()
+			results := []result{}
+			for j, m := 0, sr.count(); j < m && sr.err == nil; j++ {
+				results = append(results, sr.result())
+			}
+			db.results[id] = results
+		}
+		for i, n := 0, sr.count(); i < n && sr.err == nil; i++ {
+			id := sr.id()
+			proofs := []proof{}
+			for j, m := 0, sr.count(); j < m && sr.err == nil; j++ {
+				proofs = append(proofs, sr.proof())
+			}
+			db.proofs[id] = proofs
+		}
+		for i, n := 0, sr.count(); i < n && sr.err == nil; i++ {
+			id := sr.id()
+			inv := &invalidation{subgoal: sr.literal()}
+			inv.dependentSubgoals = []uuid.UUID{}
+			for j, m := 0, sr.count(); j < m && sr.err == nil; j++ {
+				inv.dependentSubgoals = append(inv.dependentSubgoals, sr.id())
+			}
+			db.invalidations[id] = inv
+		}
+	}
+
+	if sr.err != nil {
+		return nil, fmt.Errorf("reading snapshot: %v", sr.err)
+	}
+	return db, nil
+}
+
+func (db *Database) save(w io.Writer, withResults bool) error {
+	db.internMutex.RLock()
+	defer db.internMutex.RUnlock()
+	db.clauseMutex.RLock()
+	defer db.clauseMutex.RUnlock()
+
+	bw := bufio.NewWriter(w)
+	sw := snapshotWriter{w: bw}
+
+	var flags byte
+	if withResults {
+		flags |= snapshotHasResults
+	}
+	sw.write(snapshotMagic)
+	sw.write(snapshotVersion)
+	sw.write(flags)
+
+	// Interning
+	sw.write(db.vars)
+	sw.write(db.internCount)
+	// Maps are written in order of their keys, so that a database always has the same snapshot
+	values := make([]int64, 0, len(db.internedLookup))
+	for v := range db.internedLookup {
+		values = append(values, v)
+	}
+	sortValues(values)
+	sw.count(len(values))
+	for _, v := range values {
+		sw.write(v)
+		sw.string(db.internedLookup[v])
+	}
+	values = make([]int64, 0, len(db.setLookup))
+	for v := range db.setLookup {
+		values = append(values, v)
+	}
+	sortValues(values)
+	sw.count(len(values))
+	for _, v := range values {
+		s := db.setLookup[v]
+		sw.write(v)
+		sw.count(len(s.items))
+		for _, item := range s.items {
+			sw.term(item)
+		}
+	}
+
+	// Clauses
+	ids := make([]uuid.UUID, 0, len(db.clauses))
+	for id := range db.clauses {
+		ids = append(ids, id)
+	}
+	sortIDs(ids)
+	sw.count(len(ids))
+	for _, id := range ids {
+		sw.id(id)
+		sw.clause(db.clauses[id])
+	}
+
+	if withResults {
+		db.resultsMutex.RLock()
+		defer db.resultsMutex.RUnlock()
+
+		ids = make([]uuid.UUID, 0, len(db.results))
+		for id := range db.results {
+			ids = append(ids, id)
+		}
+		sortIDs(ids)
+		sw.count(len(ids))
+		for _, id := range ids {
+			results := db.results[id]
+			sw.id(id)
+			sw.literal(db.cachedSubgoals[id])
+			sw.count(len(results))
+			for _, r := range results {
+				sw.result(r)
+			}
+		}
+		ids = make([]uuid.UUID, 0, len(db.proofs))
+		for id := range db.proofs {
+			ids = append(ids, id)
+		}
+		sortIDs(ids)
+		sw.count(len(ids))
+		for _, id := range ids {
+			proofs := db.proofs[id]
+			sw.id(id)
+			sw.count(len(proofs))
+			for _, p := range proofs {
+				sw.proof(p)
+			}
+		}
+		ids = make([]uuid.UUID, 0, len(db.invalidations))
+		for id := range db.invalidations {
+			ids = append(ids, id)
+		}
+		sortIDs(ids)
+		sw.count(len(ids))
+		for _, id := range ids {
+			inv := db.invalidations[id]
+			sw.id(id)
+			sw.literal(inv.subgoal)
+			sw.count(len(inv.dependentSubgoals))
+			for _, d := range inv.dependentSubgoals {
+				sw.id(d)
+			}
+		}
+	}
+
+	if sw.err != nil {
+		return sw.err
+	}
+	return bw.Flush()
+}
+
+// snapshotWriter holds on to the first error encountered, so that encoding can proceed
+// without checking every write.
+type snapshotWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (sw *snapshotWriter) write(v interface{}) {
+	if sw.err == nil {
+		sw.err = binary.Write(sw.w, binary.LittleEndian, v)
+	}
+}
+
+func (sw *snapshotWriter) count(n int) {
+	sw.write(uint32(n))
+}
+
+func (sw *snapshotWriter) bool(b bool) {
+	if b {
+		sw.write(byte(1))
+	} else {
+		sw.write(byte(0))
+	}
+}
+
+func (sw *snapshotWriter) string(s string) {
+	sw.count(len(s))
+	if sw.err == nil {
+		_, sw.err = io.WriteString(sw.w, s)
+	}
+}
+
+func (sw *snapshotWriter) id(id uuid.UUID) {
+	sw.write(id)
+}
+
+func (sw *snapshotWriter) position(p Position) {
+	sw.string(p.Filename)
+	sw.write(int64(p.Line))
+	sw.write(int64(p.Column))
+}
+
+func (sw *snapshotWriter) literal(l Literal) {
+	sw.bool(l.Negated)
+	sw.string(l.Predicate)
+	sw.count(len(l.Terms))
+	for _, t := range l.Terms {
+		sw.term(t)
+	}
+	sw.string(l.Aggregate)
+}
+
+func (sw *snapshotWriter) term(t Term) {
+	sw.bool(t.IsConstant)
+	sw.write(t.Kind)
+	sw.write(t.Value)
+}
+
+func (sw *snapshotWriter) clause(c Clause) {
+	sw.literal(c.Head)
+	sw.count(len(c.Body))
+	for _, l := range c.Body {
+		sw.literal(l)
+	}
+	sw.position(c.Span.Start)
+	sw.position(c.Span.End)
+}
+
+func (sw *snapshotWriter) environment(env environment) {
+	sw.count(env.count)
+	env.forEach(func(k int64, v Term) {
+		sw.write(k)
+		sw.term(v)
+	})
+}
+
+func (sw *snapshotWriter) proof(p proof) {
+	sw.bool(p.success)
+	sw.id(p.Clause)
+	sw.environment(p.substitutions)
+	sw.bool(p.external != nil)
+	if p.external != nil {
+		sw.string(p.external.Relation)
+		sw.literal(p.external.Input)
+		sw.string(p.external.Table)
+		sw.string(p.external.Query)
+	}
+}
+
+func (sw *snapshotWriter) result(r result) {
+	sw.bool(r.isFailure)
+	sw.environment(r.env)
+	sw.literal(r.Literal)
+	sw.proof(r.proof)
+	ids := make([]uuid.UUID, 0, len(r.invalidators))
+	for id := range r.invalidators {
+		ids = append(ids, id)
+	}
+	sortIDs(ids)
+	sw.count(len(ids))
+	for _, id := range ids {
+		sw.id(id)
+		sw.literal(r.invalidators[id])
+	}
+}
+
+func sortValues(values []int64) {
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+}
+
+// snapshotReader mirrors snapshotWriter. Once an error is encountered, all further reads
+// return zero values. Since snapshots may be corrupt or truncated, slices and strings grow as
+// their elements are read, rather than being allocated at the length that the snapshot claims.
+type snapshotReader struct {
+	r   io.Reader
+	err error
+}
+
+func (sr *snapshotReader) read(v interface{}) {
+	if sr.err == nil {
+		sr.err = binary.Read(sr.r, binary.LittleEndian, v)
+	}
+}
+
+func (sr *snapshotReader) count() int {
+	var n uint32
+	sr.read(&n)
+	return int(n)
+}
+
+func (sr *snapshotReader) bool() bool {
+	var b byte
+	sr.read(&b)
+	return b != 0
+}
+
+func (sr *snapshotReader) string() string {
+	n := sr.count()
+	if sr.err != nil {
+		return ""
+	}
+	var buf strings.Builder
+	copied, err := io.CopyN(&buf, sr.r, int64(n))
+	if copied < int64(n) {
+		sr.err = io.ErrUnexpectedEOF
+	} else if err != nil {
+		sr.err = err
+	}
+	return buf.String()
+}
+
+func (sr *snapshotReader) id() uuid.UUID {
+	var id uuid.UUID
+	sr.read(&id)
+	return id
+}
+
+func (sr *snapshotReader) position() Position {
+	var line, column int64
+	p := Position{Filename: sr.string()}
+	sr.read(&line)
+	sr.read(&column)
+	p.Line = int(line)
+	p.Column = int(column)
+	return p
+}
+
+func (sr *snapshotReader) literal() Literal {
+	l := Literal{
+		Negated:   sr.bool(),
+		Predicate: sr.string(),
+	}
+	for i, n := 0, sr.count(); i < n && sr.err == nil; i++ {
+		l.Terms = append(l.Terms, sr.term())
+	}
+	l.Aggregate = sr.string()
+	return l
+}
+
+func (sr *snapshotReader) term() Term {
+	t := Term{IsConstant: sr.bool()}
+	sr.read(&t.Kind)
+	sr.read(&t.Value)
+	return t
+}
+
+func (sr *snapshotReader) clause() Clause {
+	c := Clause{Head: sr.literal(), Body: []Literal{}}
+	for i, n := 0, sr.count(); i < n && sr.err == nil; i++ {
+		c.Body = append(c.Body, sr.literal())
+	}
+	c.Span.Start = sr.position()
+	c.Span.End = sr.position()
+	return c
+}
+
+func (sr *snapshotReader) environment() environment {
+	env := emptyEnvironment()
+	for i, n := 0, sr.count(); i < n && sr.err == nil; i++ {
+		var k int64
+		sr.read(&k)
+		t := sr.term()
+		// bind panics on rebinding a variable or binding it to itself
+		if v := (Term{Value: k}); sr.err == nil && (env.chase(v) != v || !t.IsConstant && t.Value == k) {
+			sr.err = fmt.Errorf("variable %v is bound more than once, or to itself", k)
+		}
+		if sr.err == nil {
+			env.bind(k, t)
+		}
+	}
+	return env
+}
+
+func (sr *snapshotReader) proof() proof {
+	p := proof{
+		success:       sr.bool(),
+		Clause:        sr.id(),
+		substitutions: sr.environment(),
+	}
+	if sr.bool() {
+		p.external = &ExternalOrigin{
+			Relation: sr.string(),
+			Input:    sr.literal(),
+			Table:    sr.string(),
+			Query:    sr.string(),
+		}
+	}
+	return p
+}
+
+func (sr *snapshotReader) result() result {
+	r := result{
+		isFailure:    sr.bool(),
+		env:          sr.environment(),
+		Literal:      sr.literal(),
+		proof:        sr.proof(),
+		invalidators: map[uuid.UUID]Literal{},
+	}
+	for i, n := 0, sr.count(); i < n && sr.err == nil; i++ {
+		id := sr.id()
+		r.invalidators[id] = sr.literal()
+	}
+	return r
+}
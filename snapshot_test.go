@@ -0,0 +1,178 @@
+package authalog
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+)
+
+var snapshotData = `
+parent(john, douglas).
+parent(bob, john).
+parent(ebbon, bob).
+ancestor(A, B) :- parent(A, B).
+ancestor(A, B) :- parent(A, C), ancestor(C, B).
+founder(A) :- parent(A, B), !child(A), A in [ebbon, bob].
+child(A) :- parent(B, A).
+`
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	db := dbFromString(t, snapshotData)
+	_, err := db.Apply(db.ParseCommandOrPanic("ancestor(X, douglas)?"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	for _, withResults := range []bool{false, true} {
+		var buf bytes.Buffer
+		if withResults {
+			err = db.SaveWithResults(&buf)
+		} else {
+			err = db.Save(&buf)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		loaded, err := LoadDatabase(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(loaded.clauses) != len(db.clauses) {
+			t.Errorf("Expected %v clauses, got %v", len(db.clauses), len(loaded.clauses))
+		}
+		if withResults && len(loaded.results) != len(db.results) {
+			t.Errorf("Expected %v cached results, got %v", len(db.results), len(loaded.results))
+		}
+		if !withResults && len(loaded.results) != 0 {
+			t.Errorf("Expected no cached results, got %v", len(loaded.results))
+		}
+
+		r, err := loaded.Apply(loaded.ParseCommandOrPanic("ancestor(X, douglas)?"))
+		if err != nil {
+			t.Error(err)
+		}
+		compareDatalogResult(t, loaded.ToString(r), `ancestor(john, douglas).
+ancestor(bob, douglas).
+ancestor(ebbon, douglas).
+`)
+		r, err = loaded.Apply(loaded.ParseCommandOrPanic("founder(X)?"))
+		if err != nil {
+			t.Error(err)
+		}
+		compareDatalogResult(t, loaded.ToString(r), `founder(ebbon).
+`)
+
+		// Loaded databases carry on interning and checking where the original left off
+		_, err = loaded.Apply(loaded.ParseCommandOrPanic("parent(douglas, zed)."))
+		if err != nil {
+			t.Error(err)
+		}
+		r, err = loaded.Apply(loaded.ParseCommandOrPanic("ancestor(bob, X)?"))
+		if err != nil {
+			t.Error(err)
+		}
+		compareDatalogResult(t, loaded.ToString(r), `ancestor(bob, john).
+ancestor(bob, douglas).
+ancestor(bob, zed).
+`)
+		_, err = loaded.Apply(loaded.ParseCommandOrPanic("child(A) :- parent(B, A), !founder(A)."))
+		if err == nil {
+			t.Error("Expected a stratification error after loading")
+		}
+	}
+}
+
+func TestSnapshotInvalid(t *testing.T) {
+	_, err := LoadDatabase(strings.NewReader("not a snapshot"))
+	if err == nil {
+		t.Error("Expected an error loading garbage")
+	}
+
+	var buf bytes.Buffer
+	err = dbFromString(t, snapshotData).Save(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadDatabase(bytes.NewReader(buf.Bytes()[:buf.Len()-10]))
+	if err == nil {
+		t.Error("Expected an error loading a truncated snapshot")
+	}
+
+	// Snapshots cut short anywhere fail to load, rather than panicking
+	db := dbFromString(t, snapshotData)
+	_, err = db.Apply(db.ParseCommandOrPanic("founder(X)?"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	err = db.SaveWithResults(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < buf.Len(); n++ {
+		_, err = LoadDatabase(bytes.NewReader(buf.Bytes()[:n]))
+		if err == nil {
+			t.Fatalf("Expected an error loading a snapshot cut to %v bytes", n)
+		}
+	}
+
+	// Counts larger than the snapshot are not allocated up front
+	var header bytes.Buffer
+	sw := snapshotWriter{w: &header}
+	sw.write(snapshotMagic)
+	sw.write(snapshotVersion)
+	sw.write(byte(0))
+	sw.write(int64(0))
+	sw.write(int64(0))
+	sw.count(1)
+	sw.write(int64(1))
+	sw.count(math.MaxUint32)
+	_, err = LoadDatabase(&header)
+	if err == nil {
+		t.Error("Expected an error loading a string longer than the snapshot")
+	}
+
+	// Environments that bind a variable twice, or to itself, are rejected
+	twice := []binding{{1, Term{IsConstant: true, Value: 1}}, {1, Term{IsConstant: true, Value: 2}}}
+	itself := []binding{{1, Term{Value: 1}}}
+	for _, bindings := range [][]binding{twice, itself} {
+		var env bytes.Buffer
+		sw = snapshotWriter{w: &env}
+		sw.count(len(bindings))
+		for _, b := range bindings {
+			sw.write(b.k)
+			sw.term(b.v)
+		}
+		sr := snapshotReader{r: &env}
+		sr.environment()
+		if sr.err == nil {
+			t.Errorf("Expected an error reading bindings of %v", bindings)
+		}
+	}
+}
+
+func TestSnapshotDeterministic(t *testing.T) {
+	db := dbFromString(t, snapshotData)
+	_, err := db.Apply(db.ParseCommandOrPanic("founder(X)?"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var first bytes.Buffer
+	err = db.SaveWithResults(&first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Map iteration order varies from one range to the next, so repeated saves would differ
+	for i := 0; i < 10; i++ {
+		var buf bytes.Buffer
+		err = db.SaveWithResults(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), first.Bytes()) {
+			t.Fatal("Expected saving the same database to write the same snapshot")
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package authalog
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// SQLDialect determines how the queries made by SQL external relations are written: how
+// placeholders for their arguments look, and how table and column names are quoted.
+type SQLDialect int
+
+const (
+	// SQLDialectPostgres writes placeholders as $1, $2, and quotes identifiers as "name" once
+	// they are folded to lower case, as Postgres folds unquoted names. Table: "Users" reads
+	// the table users, just as it would unquoted. It is the default.
+	SQLDialectPostgres SQLDialect = iota
+	// SQLDialectMySQL writes placeholders as ?, and quotes identifiers as `name`.
+	SQLDialectMySQL
+	// SQLDialectSQLServer writes placeholders as @p1, @p2, and quotes identifiers as [name].
+	SQLDialectSQLServer
+	// SQLDialectOracle writes named placeholders as :p1, :p2, passing arguments with
+	// sql.Named, and quotes identifiers as "name". Queries are not terminated with ';'.
+	SQLDialectOracle
+)
+
+func (d SQLDialect) String() string {
+	switch d {
+	case SQLDialectPostgres:
+		return "postgres"
+	case SQLDialectMySQL:
+		return "mysql"
+	case SQLDialectSQLServer:
+		return "sqlserver"
+	case SQLDialectOracle:
+		return "oracle"
+	}
+	return fmt.Sprintf("SQLDialect(%d)", int(d))
+}
+
+// placeholder returns the placeholder for the n'th argument of a query, counting from 1.
+func (d SQLDialect) placeholder(n int) string {
+	switch d {
+	case SQLDialectMySQL:
+		return "?"
+	case SQLDialectSQLServer:
+		return fmt.Sprintf("@p%d", n)
+	case SQLDialectOracle:
+		return fmt.Sprintf(":p%d", n)
+	}
+	return fmt.Sprintf("$%d", n)
+}
+
+// arg wraps v, the n'th argument of a query, as its placeholder requires.
+func (d SQLDialect) arg(n int, v interface{}) interface{} {
+	if d == SQLDialectOracle {
+		return sql.Named(fmt.Sprintf("p%d", n), v)
+	}
+	return v
+}
+
+// quote quotes each part of a possibly qualified identifier, like schema.table, doubling any
+// closing quotes within it.
+func (d SQLDialect) quote(identifier string) string {
+	identifier = d.fold(identifier)
+	open, close := `"`, `"`
+	switch d {
+	case SQLDialectMySQL:
+		open, close = "`", "`"
+	case SQLDialectSQLServer:
+		open, close = "[", "]"
+	}
+	parts := strings.Split(identifier, ".")
+	for i, p := range parts {
+		parts[i] = open + strings.Replace(p, close, close+close, -1) + close
+	}
+	return strings.Join(parts, ".")
+}
+
+// fold returns identifier as the dialect quotes it: in lower case for Postgres, and unchanged
+// otherwise.
+func (d SQLDialect) fold(identifier string) string {
+	if d == SQLDialectPostgres {
+		return strings.ToLower(identifier)
+	}
+	return identifier
+}
+
+// sameIdentifier reports whether a, a name read from the database, is the one that quoting b
+// refers to. Quoted identifiers are case sensitive in Postgres and Oracle, but not in MySQL or
+// SQL Server's default collations.
+func (d SQLDialect) sameIdentifier(a, b string) bool {
+	if d == SQLDialectPostgres || d == SQLDialectOracle {
+		return a == d.fold(b)
+	}
+	return strings.EqualFold(a, b)
+}
+
+func (d SQLDialect) quoteAll(identifiers []string) []string {
+	quoted := make([]string, len(identifiers))
+	for i, id := range identifiers {
+		quoted[i] = d.quote(id)
+	}
+	return quoted
+}
+
+// maxParameters returns the number of parameters that a query may safely have. SQL Server
+// allows 2100, and Oracle at most 1000 expressions in an IN list; others allow 65535.
+func (d SQLDialect) maxParameters() int {
+	switch d {
+	case SQLDialectSQLServer:
+		return 2000
+	case SQLDialectOracle:
+		return 1000
+	}
+	return 65535
+}
+
+// terminate ends a query.
+func (d SQLDialect) terminate(query string) string {
+	if d == SQLDialectOracle {
+		return query
+	}
+	return query + ";"
+}
+
+// matchAny returns a condition holding for rows whose columns equal any of tuples, each of
+// which holds a placeholder per column. Postgres, like sqlite, compares row values with a
+// VALUES list; other dialects spell out each tuple.
+func (d SQLDialect) matchAny(columns []string, tuples [][]string) string {
+	if len(columns) == 1 {
+		placeholders := make([]string, len(tuples))
+		for i, t := range tuples {
+			placeholders[i] = t[0]
+		}
+		return fmt.Sprintf("%s IN (%s)", columns[0], strings.Join(placeholders, ", "))
+	}
+	if d == SQLDialectPostgres {
+		rows := make([]string, len(tuples))
+		for i, t := range tuples {
+			rows[i] = "(" + strings.Join(t, ", ") + ")"
+		}
+		return fmt.Sprintf("(%s) IN (VALUES %s)", strings.Join(columns, ", "), strings.Join(rows, ", "))
+	}
+	conditions := make([]string, len(tuples))
+	for i, t := range tuples {
+		equalities := make([]string, len(columns))
+		for j, c := range columns {
+			equalities[j] = fmt.Sprintf("%s = %s", c, t[j])
+		}
+		conditions[i] = "(" + strings.Join(equalities, " AND ") + ")"
+	}
+	return strings.Join(conditions, " OR ")
+}
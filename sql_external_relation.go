@@ -1,10 +1,12 @@
 package authalog
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"reflect"
 	"strings"
+	"time"
 )
 
 type SQLExternalRelationSpec struct {
@@ -15,10 +17,22 @@ type SQLExternalRelationSpec struct {
 	// 		Types: []interface{}{0, "", MyEnumValue}
 	// For a database relation that has a tuple of types (int, string, MyEnum).
 	Types []interface{}
+	// Modes, if set, are the binding patterns that the relation may be queried with, as for
+	// ExternalRelation.WithModes. For example, Modes: []string{"+-", "-+"} requires that
+	// either column be bound, so that the table is never read without a WHERE clause.
+	Modes []string
+	// Dialect determines how queries are written for the database. It defaults to
+	// SQLDialectPostgres.
+	Dialect SQLDialect
+	// Numbers, if set, makes columns of Go's numeric types produce numbers, which compare
+	// numerically and match numerals like 2 in rules. Otherwise every column produces atoms,
+	// which match constants like '2'.
+	Numbers bool
 }
 
 func sqlQueryForTerms(intern interner, spec SQLExternalRelationSpec, terms []Term) (string, []interface{}, error) {
-	query := fmt.Sprintf(`SELECT %s FROM %s`, strings.Join(spec.Columns, ", "), spec.Table)
+	d := spec.Dialect
+	query := fmt.Sprintf(`SELECT %s FROM %s`, strings.Join(d.quoteAll(spec.Columns), ", "), d.quote(spec.Table))
 
 	hasWhere := false
 	for _, t := range terms {
@@ -35,48 +49,169 @@ func sqlQueryForTerms(intern interner, spec SQLExternalRelationSpec, terms []Ter
 				if whered > 0 {
 					query = query + " AND "
 				}
-				query = query + fmt.Sprintf("%s = $%d", spec.Columns[i], whered+1)
-
-				str := intern.lookup(t.Value)
-				switch spec.Types[i].(type) {
-				case string:
-					args = append(args, str)
-				case int:
-					// TODO should we parse it
-					args = append(args, str)
-				case bool:
-					// TODO: parse and validate?
-					if strings.ToLower(str) == "true" {
-						args = append(args, true)
-					} else {
-						args = append(args, false)
-					}
-				default:
-					to := reflect.TypeOf(spec.Types[i])
-					// Convert pointers to their element types when we're serializing, because the .Scan() interface
-					// isn't implemented on pointers.
-					if to.Kind() == reflect.Ptr {
-						to = to.Elem()
-					}
-					v := reflect.New(to)
-					mv := v.MethodByName("Scan")
-					if !mv.IsValid() {
-						return "", nil, fmt.Errorf("Cannot find scan method on %v for string %v", spec.Types[i], str)
-					}
-					_ = v.MethodByName("Scan").Call([]reflect.Value{reflect.ValueOf(str)})
-					args = append(args, v.Interface())
+				query = query + fmt.Sprintf("%s = %s", d.quote(spec.Columns[i]), d.placeholder(whered+1))
+
+				arg, err := sqlArg(intern, spec, i, t)
+				if err != nil {
+					return "", nil, err
 				}
+				args = append(args, d.arg(whered+1, arg))
 
 				whered = whered + 1
 			}
 		}
 	}
-	query = query + ";"
+	query = d.terminate(query)
+
+	trace("Query", query, "Args", args)
+	return query, args, nil
+}
+
+// sqlArg converts the constant t to the argument compared with the i'th column.
+func sqlArg(intern interner, spec SQLExternalRelationSpec, i int, t Term) (interface{}, error) {
+	str := constantString(intern, t)
+	switch spec.Types[i].(type) {
+	case string:
+		return str, nil
+	case int:
+		// TODO should we parse it
+		return str, nil
+	case bool:
+		// TODO: parse and validate?
+		return strings.ToLower(str) == "true", nil
+	default:
+		to := reflect.TypeOf(spec.Types[i])
+		// Convert pointers to their element types when we're serializing, because the .Scan() interface
+		// isn't implemented on pointers.
+		if to.Kind() == reflect.Ptr {
+			to = to.Elem()
+		}
+		v := reflect.New(to)
+		mv := v.MethodByName("Scan")
+		if !mv.IsValid() {
+			return nil, fmt.Errorf("Cannot find scan method on %v for string %v", spec.Types[i], str)
+		}
+		_ = v.MethodByName("Scan").Call([]reflect.Value{reflect.ValueOf(str)})
+		return v.Interface(), nil
+	}
+}
+
+// sqlBatchSize limits the number of calls answered by a single query. Queries are also kept
+// within their dialect's limit on parameters.
+const sqlBatchSize = 500
+
+// sqlBatch is a query answering some of a batch of calls, each of which binds the same
+// columns.
+type sqlBatch struct {
+	calls []int
+	query string
+	args  []interface{}
+}
+
+// sqlBatches plans the queries that answer a batch of calls: one for each set of columns
+// that the calls bind, selecting the rows that match any of them, as with
+// WHERE (col1, col2) IN (VALUES ($1, $2), ($3, $4)).
+func sqlBatches(intern interner, spec SQLExternalRelationSpec, calls [][]Term) ([]sqlBatch, error) {
+	groups := map[string][]int{}
+	modes := []string{}
+	for i, terms := range calls {
+		m := callMode(terms, nil)
+		if _, ok := groups[m]; !ok {
+			modes = append(modes, m)
+		}
+		groups[m] = append(groups[m], i)
+	}
+
+	batches := []sqlBatch{}
+	for _, m := range modes {
+		size := sqlBatchSize
+		if bound := strings.Count(m, "+"); bound > 0 && spec.Dialect.maxParameters()/bound < size {
+			size = spec.Dialect.maxParameters() / bound
+		}
+		group := groups[m]
+		for len(group) > 0 {
+			n := len(group)
+			if n > size {
+				n = size
+			}
+			b := sqlBatch{calls: group[:n]}
+			group = group[n:]
+
+			var err error
+			b.query, b.args, err = sqlQueryForCalls(intern, spec, calls, b.calls)
+			if err != nil {
+				return nil, err
+			}
+			batches = append(batches, b)
+		}
+	}
+	return batches, nil
+}
+
+func sqlQueryForCalls(intern interner, spec SQLExternalRelationSpec, calls [][]Term, indices []int) (string, []interface{}, error) {
+	bound := []int{}
+	for j, t := range calls[indices[0]] {
+		if t.IsConstant {
+			bound = append(bound, j)
+		}
+	}
+	// Calls binding no columns all read the whole table
+	if len(indices) == 1 || len(bound) == 0 {
+		return sqlQueryForTerms(intern, spec, calls[indices[0]])
+	}
+
+	d := spec.Dialect
+	columns := make([]string, len(bound))
+	for k, j := range bound {
+		columns[k] = d.quote(spec.Columns[j])
+	}
+	args := []interface{}{}
+	tuples := make([][]string, len(indices))
+	for k, i := range indices {
+		tuples[k] = make([]string, len(bound))
+		for l, j := range bound {
+			arg, err := sqlArg(intern, spec, j, calls[i][j])
+			if err != nil {
+				return "", nil, err
+			}
+			args = append(args, d.arg(len(args)+1, arg))
+			tuples[k][l] = d.placeholder(len(args))
+		}
+	}
+
+	query := d.terminate(fmt.Sprintf(`SELECT %s FROM %s WHERE %s`, strings.Join(d.quoteAll(spec.Columns), ", "), d.quote(spec.Table), d.matchAny(columns, tuples)))
 
 	trace("Query", query, "Args", args)
 	return query, args, nil
 }
 
+// rowMatches returns true if row has the constants of terms in each of their positions.
+func rowMatches(row []Term, terms []Term) bool {
+	for j, t := range terms {
+		if t.IsConstant && row[j] != t {
+			return false
+		}
+	}
+	return true
+}
+
+// sqlTerm converts a value scanned from a column to a term, with the column's example type t.
+func sqlTerm(in interner, spec SQLExternalRelationSpec, t reflect.Type, v reflect.Value) Term {
+	asT := v.Convert(t).Interface()
+
+	if n, ok := numberTerm(asT); ok && spec.Numbers {
+		return n
+	}
+	return Term{IsConstant: true, Value: in.intern(fmt.Sprint(asT))}
+}
+
+// sqlTable is the table that a SQL external relation reads.
+type sqlTable struct {
+	db    *sql.DB
+	spec  SQLExternalRelationSpec
+	types []reflect.Type
+}
+
 func makeVars(n int) []Term {
 	r := make([]Term, n)
 	for i := 0; i < n; i++ {
@@ -85,6 +220,84 @@ func makeVars(n int) []Term {
 	return r
 }
 
+var (
+	scannerType = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+	timeType    = reflect.TypeOf(time.Time{})
+)
+
+// sqlTypeClass groups the types that values can be scanned into by the kind of value they
+// hold, so that an example type can be compared with the type the driver reports for a
+// column. It returns "" for types whose values could be anything.
+func sqlTypeClass(t reflect.Type) string {
+	switch t {
+	case reflect.TypeOf(sql.NullInt64{}), reflect.TypeOf(sql.NullInt32{}), reflect.TypeOf(sql.NullFloat64{}):
+		return "number"
+	case reflect.TypeOf(sql.NullString{}):
+		return "text"
+	case reflect.TypeOf(sql.NullBool{}):
+		return "boolean"
+	case timeType, reflect.TypeOf(sql.NullTime{}):
+		return "time"
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "text"
+	case reflect.Bool:
+		return "boolean"
+	}
+	return ""
+}
+
+// sqlTypesCompatible reports whether values of a column, which the driver scans as column,
+// can be scanned into example. Any column can be read as text, and booleans may be stored
+// as numbers; types that scan themselves are trusted to handle their columns.
+func sqlTypesCompatible(column reflect.Type, example reflect.Type) bool {
+	if reflect.PtrTo(example).Implements(scannerType) {
+		return true
+	}
+	c, e := sqlTypeClass(column), sqlTypeClass(example)
+	if c == "" || e == "" || c == e || e == "text" {
+		return true
+	}
+	return e == "boolean" && c == "number"
+}
+
+// checkSQLSchema makes sure that spec's table exists and has each of its columns, with types
+// that its example types can be scanned from, by inspecting a query that returns no rows.
+func checkSQLSchema(spec SQLExternalRelationSpec, db *sql.DB, rt []reflect.Type) error {
+	d := spec.Dialect
+	rows, err := db.Query(d.terminate(fmt.Sprintf("SELECT * FROM %s WHERE 1 = 0", d.quote(spec.Table))))
+	if err != nil {
+		return fmt.Errorf("For %v, could not read the table: %v", spec.Table, err)
+	}
+	defer rows.Close()
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return fmt.Errorf("For %v, could not read the column types: %v", spec.Table, err)
+	}
+
+	for i, c := range spec.Columns {
+		var found *sql.ColumnType
+		for _, ct := range columnTypes {
+			if d.sameIdentifier(ct.Name(), c) {
+				found = ct
+				break
+			}
+		}
+		if found == nil {
+			return fmt.Errorf("For %v, column %v does not exist", spec.Table, c)
+		}
+		if st := found.ScanType(); st != nil && rt[i] != nil && !sqlTypesCompatible(st, rt[i]) {
+			return fmt.Errorf("For %v, column %v has type %v, which cannot be read as %v", spec.Table, c, found.DatabaseTypeName(), rt[i])
+		}
+	}
+	return rows.Err()
+}
+
 func CreateSQLExternalRelation(spec SQLExternalRelationSpec, db *sql.DB) (ExternalRelation, error) {
 
 	// Vet the relation
@@ -96,12 +309,12 @@ func CreateSQLExternalRelation(spec SQLExternalRelationSpec, db *sql.DB) (Extern
 	for i, t := range spec.Types {
 		rt[i] = reflect.TypeOf(t)
 	}
-	runner := func(in interner, terms []Term) ([][]Term, error) {
-		q, args, err := sqlQueryForTerms(in, spec, terms)
-		if err != nil {
-			return nil, err
-		}
-		rows, err := db.Query(q, args...)
+	err := checkSQLSchema(spec, db, rt)
+	if err != nil {
+		return ExternalRelation{}, err
+	}
+	rows := func(ctx context.Context, in interner, q string, args []interface{}) ([][]Term, error) {
+		rows, err := db.QueryContext(ctx, q, args...)
 		if err == sql.ErrNoRows {
 			return [][]Term{}, nil
 		}
@@ -125,14 +338,7 @@ func CreateSQLExternalRelation(spec SQLExternalRelationSpec, db *sql.DB) (Extern
 
 			r := make([]Term, len(destinationPointers))
 			for i, dp := range destinationPointers {
-				var stringValue string
-				asT := reflect.ValueOf(dp).Elem().Convert(rt[i]).Interface()
-
-				stringValue = fmt.Sprint(asT)
-
-				v := in.intern(stringValue)
-
-				r[i] = Term{IsConstant: true, Value: v}
+				r[i] = sqlTerm(in, spec, rt[i], reflect.ValueOf(dp).Elem())
 			}
 			results = append(results, r)
 		}
@@ -142,12 +348,54 @@ func CreateSQLExternalRelation(spec SQLExternalRelationSpec, db *sql.DB) (Extern
 		}
 		return results, err
 	}
+	runner := func(ctx context.Context, in interner, terms []Term) ([][]Term, error) {
+		q, args, err := sqlQueryForTerms(in, spec, terms)
+		if err != nil {
+			return nil, err
+		}
+		return rows(ctx, in, q, args)
+	}
+	batch := func(ctx context.Context, in interner, calls [][]Term) ([][][]Term, error) {
+		batches, err := sqlBatches(in, spec, calls)
+		if err != nil {
+			return nil, err
+		}
+		results := make([][][]Term, len(calls))
+		for _, b := range batches {
+			rs, err := rows(ctx, in, b.query, b.args)
+			if err != nil {
+				return nil, err
+			}
+			// Each row answers the calls whose bound columns it matches
+			for _, r := range rs {
+				for _, i := range b.calls {
+					if rowMatches(r, calls[i]) {
+						results[i] = append(results[i], r)
+					}
+				}
+			}
+		}
+		return results, nil
+	}
 
 	return ExternalRelation{
 		head: Literal{
 			Predicate: spec.Table,
 			Terms:     makeVars(len(spec.Columns)),
 		},
-		run: runner,
-	}, nil
+		run:   runner,
+		batch: batch,
+		table: &sqlTable{db: db, spec: spec, types: rt},
+		describe: func(in interner, calls [][]Term) []ExternalOrigin {
+			// Errors would have been returned by batch, before any facts were produced
+			batches, _ := sqlBatches(in, spec, calls)
+			origins := make([]ExternalOrigin, len(calls))
+			for _, b := range batches {
+				for _, i := range b.calls {
+					origins[i] = ExternalOrigin{Table: spec.Table, Query: b.query}
+				}
+			}
+			return origins
+		},
+	}.WithModes(spec.Modes...)
 }
@@ -1,8 +1,11 @@
 package authalog
 
 import (
+	"context"
 	"database/sql"
-	"os"
+	"encoding/json"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -25,16 +28,23 @@ func setupDB(db *sql.DB) error {
 	return nil
 }
 
-func TestExternalSQLRule(t *testing.T) {
-	os.Remove("test.db")
-	db, err := sql.Open("sqlite3", "./test.db")
+// openTestDB opens a sqlite database, in a directory that is removed once t is done, holding
+// the users table.
+func openTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
+	t.Cleanup(func() { db.Close() })
 	err = setupDB(db)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
+	return db
+}
+
+func TestExternalSQLRule(t *testing.T) {
+	db := openTestDB(t)
 
 	spec := SQLExternalRelationSpec{
 		Table:   "users",
@@ -49,7 +59,7 @@ func TestExternalSQLRule(t *testing.T) {
 
 	mi := NewDatabase()
 	// Check full enumeration
-	terms, err := relation.run(mi, makeVars(2))
+	terms, err := relation.run(context.Background(), mi, makeVars(2))
 	if err != nil {
 		t.Error(err)
 	}
@@ -71,7 +81,7 @@ func TestExternalSQLRule(t *testing.T) {
 		IsConstant: true,
 		Value:      mi.intern("2"),
 	}
-	terms, err = relation.run(mi, qTerms)
+	terms, err = relation.run(context.Background(), mi, qTerms)
 	if err != nil {
 		t.Error(err)
 	}
@@ -95,7 +105,7 @@ func TestExternalSQLRule(t *testing.T) {
 		IsConstant: true,
 		Value:      mi.intern("Quincy"),
 	}
-	terms, err = relation.run(mi, qTerms)
+	terms, err = relation.run(context.Background(), mi, qTerms)
 	if err != nil {
 		t.Error(err)
 	}
@@ -111,3 +121,307 @@ func TestExternalSQLRule(t *testing.T) {
 		t.Errorf("Expectd 'Quincy', got %v", mi.lookup(terms[0][1].Value))
 	}
 }
+
+func TestSQLExternalRelationProof(t *testing.T) {
+	sqlDB := openTestDB(t)
+
+	relation, err := CreateSQLExternalRelation(SQLExternalRelationSpec{
+		Table:   "users",
+		Columns: []string{"id", "name"},
+		Types:   []interface{}{0, ""},
+		Numbers: true,
+	}, sqlDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := NewDatabase()
+	db.AddExternalRelations(relation)
+	cmds, err := db.Parse(strings.NewReader(`named(Name) :- users(2, Name).`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Apply(cmds[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	answers, err := db.Query(db.L("named", V("Name")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answers) != 1 {
+		t.Fatalf("Expected 1 answer, got %v", len(answers))
+	}
+
+	expected := "users(2, 'Quincy'). % From external relation users(2, _), table users: SELECT \"id\", \"name\" FROM \"users\" WHERE \"id\" = $1;"
+	if proof := answers[0].Proof(); !strings.Contains(proof, expected) {
+		t.Errorf("Expected proof to contain %v, got %v", expected, proof)
+	}
+
+	tree, err := db.ProofTree(db.L("users", 2, "Quincy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tree.Derivations) != 1 || tree.Derivations[0].Origin == nil {
+		t.Fatalf("Expected a single external derivation, got %+v", tree.Derivations)
+	}
+	origin := tree.Derivations[0].Origin
+	if origin.Relation != "users" || origin.Table != "users" {
+		t.Errorf("Expected an origin in relation and table users, got %+v", origin)
+	}
+	b, err := json.Marshal(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `"origin":{"relation":"users","input":"users(2, _)","table":"users","query":"SELECT \"id\", \"name\" FROM \"users\" WHERE \"id\" = $1;"}`
+	if !strings.Contains(string(b), expected) {
+		t.Errorf("Expected JSON to contain %v, got %v", expected, string(b))
+	}
+}
+
+func TestSQLExternalRelationNumbers(t *testing.T) {
+	sqlDB := openTestDB(t)
+
+	// Numeric columns produce atoms unless the spec asks for numbers
+	for numbers, expected := range map[bool]string{
+		false: "named('Quincy').\n",
+		true:  "number('Quincy').\n",
+	} {
+		relation, err := CreateSQLExternalRelation(SQLExternalRelationSpec{
+			Table:   "users",
+			Columns: []string{"id", "name"},
+			Types:   []interface{}{0, ""},
+			Numbers: numbers,
+		}, sqlDB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db := dbFromString(t, `
+		named(Name) :- users('2', Name).
+		number(Name) :- users(2, Name).
+		`)
+		db.AddExternalRelations(relation)
+		result := ""
+		for _, p := range []string{"named", "number"} {
+			answers, err := db.Query(db.L(p, V("Name")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			result += db.ToString(answers)
+		}
+		compareDatalogResult(t, result, expected)
+	}
+}
+
+func TestSQLExternalRelationBatch(t *testing.T) {
+	sqlDB := openTestDB(t)
+
+	relation, err := CreateSQLExternalRelation(SQLExternalRelationSpec{
+		Table:   "users",
+		Columns: []string{"id", "name"},
+		Types:   []interface{}{0, ""},
+		Numbers: true,
+	}, sqlDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batches := 0
+	batch := relation.batch
+	relation.batch = func(ctx context.Context, in interner, calls [][]Term) ([][][]Term, error) {
+		batches++
+		return batch(ctx, in, calls)
+	}
+
+	db := NewDatabase()
+	db.AddExternalRelations(relation)
+	cmds, err := db.Parse(strings.NewReader(`
+	wanted(1). wanted(3). wanted(4).
+	pair(2, 'Quincy'). pair(3, 'Loki').
+	found(N) :- wanted(U), users(U, N).
+	matches(U) :- pair(U, N), users(U, N).
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cmds {
+		_, err = db.Apply(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	answers, err := db.Query(db.L("found", V("N")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareDatalogResult(t, db.ToString(answers), "found('Loki').\nfound('Flo').\n")
+	if batches != 1 {
+		t.Errorf("Expected a single batch of calls, got %v", batches)
+	}
+	expected := `table users: SELECT "id", "name" FROM "users" WHERE "id" IN ($1, $2, $3);`
+	if proof := db.ProofString(db.L("found", "Loki")); !strings.Contains(proof, expected) {
+		t.Errorf("Expected proof to contain %v, got %v", expected, proof)
+	}
+
+	answers, err = db.Query(db.L("matches", V("U")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareDatalogResult(t, db.ToString(answers), "matches(2).\n")
+	expected = `table users: SELECT "id", "name" FROM "users" WHERE ("id", "name") IN (VALUES ($1, $2), ($3, $4));`
+	if proof := db.ProofString(db.L("matches", 2)); !strings.Contains(proof, expected) {
+		t.Errorf("Expected proof to contain %v, got %v", expected, proof)
+	}
+}
+
+func TestSQLDialects(t *testing.T) {
+	sqlDB := openTestDB(t)
+	// Both the table and a column are reserved words, so every query must quote them
+	_, err := sqlDB.Exec(`
+	CREATE TABLE "order" (
+		id integer,
+		"group" text
+	);
+	INSERT INTO "order" (id, "group") VALUES
+	(1, 'admins'),
+	(2, 'users'),
+	(3, 'users');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		dialect SQLDialect
+		single  string
+		column  string
+		tuples  string
+	}{
+		{SQLDialectPostgres,
+			`SELECT "id", "group" FROM "order" WHERE "id" = $1;`,
+			`SELECT "id", "group" FROM "order" WHERE "id" IN ($1, $2);`,
+			`SELECT "id", "group" FROM "order" WHERE ("id", "group") IN (VALUES ($1, $2), ($3, $4));`},
+		{SQLDialectMySQL,
+			"SELECT `id`, `group` FROM `order` WHERE `id` = ?;",
+			"SELECT `id`, `group` FROM `order` WHERE `id` IN (?, ?);",
+			"SELECT `id`, `group` FROM `order` WHERE (`id` = ? AND `group` = ?) OR (`id` = ? AND `group` = ?);"},
+		{SQLDialectSQLServer,
+			`SELECT [id], [group] FROM [order] WHERE [id] = @p1;`,
+			`SELECT [id], [group] FROM [order] WHERE [id] IN (@p1, @p2);`,
+			`SELECT [id], [group] FROM [order] WHERE ([id] = @p1 AND [group] = @p2) OR ([id] = @p3 AND [group] = @p4);`},
+		{SQLDialectOracle,
+			`SELECT "id", "group" FROM "order" WHERE "id" = :p1`,
+			`SELECT "id", "group" FROM "order" WHERE "id" IN (:p1, :p2)`,
+			`SELECT "id", "group" FROM "order" WHERE ("id" = :p1 AND "group" = :p2) OR ("id" = :p3 AND "group" = :p4)`},
+	}
+	for _, c := range cases {
+		relation, err := CreateSQLExternalRelation(SQLExternalRelationSpec{
+			Table:   "order",
+			Columns: []string{"id", "group"},
+			Types:   []interface{}{0, ""},
+			Dialect: c.dialect,
+			Numbers: true,
+		}, sqlDB)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db := NewDatabase()
+		check := func(calls []Literal, query string, expected int) {
+			terms := make([][]Term, len(calls))
+			for i, l := range calls {
+				terms[i] = l.Terms
+			}
+			origins := relation.describe(db, terms)
+			if len(origins) != len(calls) || origins[0].Query != query {
+				t.Errorf("Expected %v to query %v, got %v", c.dialect, query, origins)
+			}
+			results, err := relation.batch(context.Background(), db, terms)
+			if err != nil {
+				t.Fatalf("%v: %v", c.dialect, err)
+			}
+			found := 0
+			for _, r := range results {
+				found += len(r)
+			}
+			if found != expected {
+				t.Errorf("Expected %v rows for %v, got %v", expected, c.dialect, found)
+			}
+		}
+		check([]Literal{db.L("order", 2, V("G"))}, c.single, 1)
+		check([]Literal{db.L("order", 1, V("G")), db.L("order", 3, V("G"))}, c.column, 2)
+		check([]Literal{db.L("order", 1, "admins"), db.L("order", 3, "admins")}, c.tuples, 1)
+	}
+
+	for d, expected := range map[SQLDialect]string{
+		SQLDialectPostgres:  `"public"."order"`,
+		SQLDialectMySQL:     "`Public`.`Order`",
+		SQLDialectSQLServer: "[Public].[Order]",
+		SQLDialectOracle:    `"Public"."Order"`,
+	} {
+		if quoted := d.quote("Public.Order"); quoted != expected {
+			t.Errorf("Expected %v to quote Public.Order as %v, got %v", d, expected, quoted)
+		}
+	}
+}
+
+func TestSQLExternalRelationSchema(t *testing.T) {
+	sqlDB := openTestDB(t)
+
+	cases := []struct {
+		spec     SQLExternalRelationSpec
+		expected string
+	}{
+		{SQLExternalRelationSpec{Table: "users", Columns: []string{"id", "name"}, Types: []interface{}{0, ""}}, ""},
+		// Any column can be read as text
+		{SQLExternalRelationSpec{Table: "users", Columns: []string{"id"}, Types: []interface{}{""}}, ""},
+		{SQLExternalRelationSpec{Table: "groups", Columns: []string{"id"}, Types: []interface{}{0}}, "For groups, could not read the table"},
+		{SQLExternalRelationSpec{Table: "users", Columns: []string{"id", "email"}, Types: []interface{}{0, ""}}, "For users, column email does not exist"},
+		{SQLExternalRelationSpec{Table: "users", Columns: []string{"id", "name"}, Types: []interface{}{0, 0}}, "For users, column name has type TEXT, which cannot be read as int"},
+		// Postgres names are folded to lower case, as unquoted names would be. Quoted names are
+		// case sensitive in Oracle, but not in MySQL
+		{SQLExternalRelationSpec{Table: "Users", Columns: []string{"ID"}, Types: []interface{}{0}}, ""},
+		{SQLExternalRelationSpec{Table: "users", Columns: []string{"ID"}, Types: []interface{}{0}, Dialect: SQLDialectOracle}, "For users, column ID does not exist"},
+		{SQLExternalRelationSpec{Table: "users", Columns: []string{"ID"}, Types: []interface{}{0}, Dialect: SQLDialectMySQL}, ""},
+	}
+	for _, c := range cases {
+		_, err := CreateSQLExternalRelation(c.spec, sqlDB)
+		if c.expected == "" {
+			if err != nil {
+				t.Errorf("Expected %v to be valid, got %v", c.spec.Columns, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Errorf("Expected error containing %v, got %v", c.expected, err)
+		}
+	}
+}
+
+func TestSQLBatchParameters(t *testing.T) {
+	db := NewDatabase()
+	spec := SQLExternalRelationSpec{
+		Table:   "events",
+		Columns: []string{"a", "b", "c", "d", "e"},
+		Types:   []interface{}{0, 0, 0, 0, 0},
+		Dialect: SQLDialectSQLServer,
+	}
+	calls := make([][]Term, 500)
+	for i := range calls {
+		calls[i] = []Term{intTerm(int64(i)), intTerm(1), intTerm(2), intTerm(3), intTerm(4)}
+	}
+	batches, err := sqlBatches(db, spec, calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answered := 0
+	for _, b := range batches {
+		if len(b.args) > spec.Dialect.maxParameters() {
+			t.Errorf("Expected at most %v parameters, got %v", spec.Dialect.maxParameters(), len(b.args))
+		}
+		answered += len(b.calls)
+	}
+	if len(batches) != 2 || answered != len(calls) {
+		t.Errorf("Expected 500 calls in 2 batches, got %v in %v", answered, len(batches))
+	}
+}
@@ -0,0 +1,321 @@
+package authalog
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// sqlJoin returns the relations answering the longest run of literals leading body that can
+// be pushed down into a single SQL query: positive literals, each provided only by a SQL
+// external relation reading the same database, and called in one of its modes given the
+// variables bound by the literals before it.
+func (db *Database) sqlJoin(body []Literal) []ExternalRelation {
+	db.clauseMutex.RLock()
+	defer db.clauseMutex.RUnlock()
+
+	relations := []ExternalRelation{}
+	bound := map[int64]struct{}{}
+	for _, l := range body {
+		if l.Negated || l.isAggregate() {
+			break
+		}
+		// Facts and rules for the predicate would contribute answers that the query cannot
+		rs := db.externalRelationsFor(l)
+		if len(rs) != 1 || rs[0].table == nil || len(db.index.candidates(l)) > 0 {
+			break
+		}
+		r := rs[0]
+		if len(relations) > 0 {
+			first := relations[0].table
+			if r.table.db != first.db || r.table.spec.Dialect != first.spec.Dialect {
+				break
+			}
+		}
+		if !r.supports(callMode(l.Terms, bound)) {
+			break
+		}
+		// Later tables must be joined on one of their columns, which is NULL exactly in the
+		// rows that the table does not match
+		if len(relations) > 0 && sqlJoinKey(l, bound) < 0 {
+			break
+		}
+		relations = append(relations, r)
+		for _, t := range l.Terms {
+			if !t.IsConstant {
+				bound[t.Value] = struct{}{}
+			}
+		}
+	}
+	return relations
+}
+
+// sqlJoinKey returns the index of the first of l's terms that is a constant or one of bound,
+// and so joins l's table to the tables before it, or -1 if there is none.
+func sqlJoinKey(l Literal, bound map[int64]struct{}) int {
+	for j, t := range l.Terms {
+		if _, ok := bound[t.Value]; t.IsConstant || ok {
+			return j
+		}
+	}
+	return -1
+}
+
+// sqlJoinKeys returns the sqlJoinKey of each literal of body after the first, whose variables
+// are bound by the literals before it.
+func sqlJoinKeys(body []Literal) []int {
+	keys := make([]int, len(body))
+	bound := map[int64]struct{}{}
+	for i, l := range body {
+		if i > 0 {
+			keys[i] = sqlJoinKey(l, bound)
+		}
+		for _, t := range l.Terms {
+			if !t.IsConstant {
+				bound[t.Value] = struct{}{}
+			}
+		}
+	}
+	return keys
+}
+
+// sqlJoinCondition compares a column of one of a join's tables with either a constant or a
+// column of an earlier table.
+type sqlJoinCondition struct {
+	column   string
+	other    string
+	constant Term
+	// The spec and column index that the constant is converted for
+	spec  SQLExternalRelationSpec
+	index int
+}
+
+// sqlQueryForJoin builds a query selecting the columns of each table read by body, with the
+// first table filtered by its constants, and each later table LEFT JOINed on its constants and
+// on the variables it shares with the tables before it. Left joins keep the rows that no later
+// table matches, so that the answers to each literal are complete for every binding of the
+// literals before it.
+func sqlQueryForJoin(intern interner, tables []*sqlTable, body []Literal) (string, []interface{}, error) {
+	d := tables[0].spec.Dialect
+	columns := []string{}
+	conditions := make([][]sqlJoinCondition, len(body))
+	first := map[int64]string{}
+	for i, l := range body {
+		spec := tables[i].spec
+		for j, t := range l.Terms {
+			column := fmt.Sprintf("t%d.%s", i, d.quote(spec.Columns[j]))
+			columns = append(columns, column)
+			if t.IsConstant {
+				conditions[i] = append(conditions[i], sqlJoinCondition{column: column, constant: t, spec: spec, index: j})
+			} else if other, ok := first[t.Value]; ok {
+				conditions[i] = append(conditions[i], sqlJoinCondition{column: column, other: other})
+			} else {
+				first[t.Value] = column
+			}
+		}
+	}
+
+	// Placeholders are numbered in the order they appear, as positional ones must be
+	args := []interface{}{}
+	render := func(conditions []sqlJoinCondition) (string, error) {
+		strs := make([]string, len(conditions))
+		for k, c := range conditions {
+			if c.other != "" {
+				strs[k] = fmt.Sprintf("%s = %s", c.column, c.other)
+				continue
+			}
+			arg, err := sqlArg(intern, c.spec, c.index, c.constant)
+			if err != nil {
+				return "", err
+			}
+			args = append(args, d.arg(len(args)+1, arg))
+			strs[k] = fmt.Sprintf("%s = %s", c.column, d.placeholder(len(args)))
+		}
+		return strings.Join(strs, " AND "), nil
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s t0", strings.Join(columns, ", "), d.quote(tables[0].spec.Table))
+	for i := 1; i < len(body); i++ {
+		on, err := render(conditions[i])
+		if err != nil {
+			return "", nil, err
+		}
+		if on == "" {
+			on = "1 = 1"
+		}
+		query = query + fmt.Sprintf(" LEFT JOIN %s t%d ON %s", d.quote(tables[i].spec.Table), i, on)
+	}
+	where, err := render(conditions[0])
+	if err != nil {
+		return "", nil, err
+	}
+	if where != "" {
+		query = query + " WHERE " + where
+	}
+	return d.terminate(query), args, nil
+}
+
+// sqlJoinRows runs a query built by sqlQueryForJoin for body, returning each row split into a
+// tuple for each table, which is nil where a left join matched nothing. Since join conditions
+// only hold between non-NULL values, a table is unmatched exactly when the column it is joined
+// on is NULL; its other columns may hold NULLs of their own.
+func sqlJoinRows(ctx context.Context, in interner, tables []*sqlTable, body []Literal, q string, args []interface{}) ([][][]Term, error) {
+	rows, err := tables[0].db.QueryContext(ctx, q, args...)
+	if err == sql.ErrNoRows {
+		return [][][]Term{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Scan into pointers, which are left nil by NULLs
+	destinationPointers := []interface{}{}
+	for _, t := range tables {
+		for _, rt := range t.types {
+			destinationPointers = append(destinationPointers, reflect.New(reflect.PtrTo(rt)).Interface())
+		}
+	}
+	keys := sqlJoinKeys(body)
+	var results [][][]Term
+	for rows.Next() {
+		err := rows.Scan(destinationPointers...)
+		if err != nil {
+			return nil, err
+		}
+
+		row := make([][]Term, len(tables))
+		column := 0
+		for i, t := range tables {
+			values := destinationPointers[column : column+len(t.types)]
+			column += len(t.types)
+			if i > 0 && reflect.ValueOf(values[keys[i]]).Elem().IsNil() {
+				continue
+			}
+			tuple := make([]Term, len(t.types))
+			for j, rt := range t.types {
+				v, err := sqlNullable(rt, reflect.ValueOf(values[j]).Elem())
+				if err != nil {
+					return nil, fmt.Errorf("For %v, column %v: %v", t.spec.Table, t.spec.Columns[j], err)
+				}
+				tuple[j] = sqlTerm(in, t.spec, rt, v)
+			}
+			row[i] = tuple
+		}
+		results = append(results, row)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	return results, nil
+}
+
+// sqlNullable returns the value of type rt that p, a pointer scanned from a column, stands
+// for. A nil pointer is a NULL, which is scanned as it would be into a value of type rt:
+// pointer types hold it as nil, and scanners are passed it.
+func sqlNullable(rt reflect.Type, p reflect.Value) (reflect.Value, error) {
+	if !p.IsNil() {
+		return p.Elem(), nil
+	}
+	if rt.Kind() == reflect.Ptr {
+		return reflect.Zero(rt), nil
+	}
+	v := reflect.New(rt)
+	if scanner, ok := v.Interface().(sql.Scanner); ok {
+		return v.Elem(), scanner.Scan(nil)
+	}
+	return reflect.Value{}, fmt.Errorf("converting NULL to %v is unsupported", rt)
+}
+
+// joinedSubgoal accumulates the tuples answering a subgoal from the rows of a join.
+type joinedSubgoal struct {
+	literal Literal
+	tuples  [][]Term
+	seen    map[uuid.UUID]struct{}
+}
+
+// pushDownJoin answers the leading literals of chain with a single query, when two or more of
+// them read tables in the same database. It stores the answers to the subgoals that searching
+// the chain will visit, for the leading literal and for each later one under every binding of
+// the literals before it, so that the chain finds them already answered as it is searched.
+func (g *goal) pushDownJoin(chain *chain) error {
+	relations := g.db.sqlJoin(chain.body)
+	if len(relations) < 2 {
+		return nil
+	}
+	body := chain.body[:len(relations)]
+	if _, ok := g.subgoals[subgoalHash(body[0])]; ok {
+		return nil
+	}
+	g.db.resultsMutex.RLock()
+	_, cached := g.db.results[body[0].id()]
+	g.db.resultsMutex.RUnlock()
+	if cached {
+		return nil
+	}
+
+	tables := make([]*sqlTable, len(relations))
+	for i, r := range relations {
+		tables[i] = r.table
+	}
+	q, args, err := sqlQueryForJoin(g.db, tables, body)
+	if err != nil {
+		return fmt.Errorf("In %v, got error: %w", relations[0].head, err)
+	}
+	trace("Running join", q)
+	rows, err := sqlJoinRows(g.ctx, g.db, tables, body, q, args)
+	if err != nil {
+		return fmt.Errorf("In %v, got error: %w", relations[0].head, err)
+	}
+
+	for i, l := range body {
+		joined := map[uuid.UUID]*joinedSubgoal{}
+		order := []uuid.UUID{}
+		for _, row := range rows {
+			env := emptyEnvironment()
+			matched := true
+			for k := 0; k < i && matched; k++ {
+				matched = row[k] != nil && unify(Literal{Predicate: body[k].Predicate, Terms: row[k]}, body[k], &env)
+			}
+			if !matched {
+				continue
+			}
+			target := env.rewrite(l)
+			id := subgoalHash(target)
+			j, ok := joined[id]
+			if !ok {
+				j = &joinedSubgoal{literal: target, seen: map[uuid.UUID]struct{}{}}
+				joined[id] = j
+				order = append(order, id)
+			}
+			if row[i] == nil {
+				continue
+			}
+			tid := Literal{Predicate: l.Predicate, Terms: row[i]}.id()
+			if _, ok := j.seen[tid]; !ok {
+				j.seen[tid] = struct{}{}
+				j.tuples = append(j.tuples, row[i])
+			}
+		}
+
+		origin := ExternalOrigin{Table: tables[i].spec.Table, Query: q}
+		for _, id := range order {
+			if _, ok := g.subgoals[id]; ok {
+				continue
+			}
+			_, _, err := g.putSubgoal(joined[id].literal, emptyEnvironment(), []dependent{})
+			if err != nil {
+				return err
+			}
+			err = g.mergeExternalTuples(g.subgoals[id], relations[i], origin, joined[id].tuples)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
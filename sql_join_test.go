@@ -0,0 +1,170 @@
+package authalog
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+func TestSQLJoinPushdown(t *testing.T) {
+	sqlDB := openTestDB(t)
+	_, err := sqlDB.Exec(`
+	CREATE TABLE posts (
+		id integer,
+		author integer
+	);
+	INSERT INTO posts (id, author) VALUES
+	(11, 3),
+	(12, 3),
+	(13, 1);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queries := 0
+	counted := func(spec SQLExternalRelationSpec) ExternalRelation {
+		relation, err := CreateSQLExternalRelation(spec, sqlDB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		batch := relation.batch
+		relation.batch = func(ctx context.Context, in interner, calls [][]Term) ([][][]Term, error) {
+			queries++
+			return batch(ctx, in, calls)
+		}
+		return relation
+	}
+
+	db := NewDatabase()
+	db.AddExternalRelations(
+		counted(SQLExternalRelationSpec{Table: "users", Columns: []string{"id", "name"}, Types: []interface{}{0, ""}, Numbers: true}),
+		counted(SQLExternalRelationSpec{Table: "posts", Columns: []string{"id", "author"}, Types: []interface{}{0, 0}, Numbers: true}))
+	cmds, err := db.Parse(strings.NewReader(`
+	authored(Name, Post) :- users(U, Name), posts(Post, U).
+	wrote(Post) :- users(U, 'Flo'), posts(Post, U).
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cmds {
+		_, err = db.Apply(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	answers, err := db.Query(db.L("wrote", V("Post")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareDatalogResult(t, db.ToString(answers), "wrote(11).\nwrote(12).\n")
+	expected := `table posts: SELECT t0."id", t0."name", t1."id", t1."author" FROM "users" t0 LEFT JOIN "posts" t1 ON t1."author" = t0."id" WHERE t0."name" = $1;`
+	if proof := db.ProofString(db.L("wrote", 11)); !strings.Contains(proof, expected) {
+		t.Errorf("Expected proof to contain %v, got %v", expected, proof)
+	}
+
+	answers, err = db.Query(db.L("authored", V("Name"), V("Post")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareDatalogResult(t, db.ToString(answers), "authored('Flo', 11).\nauthored('Flo', 12).\nauthored('Loki', 13).\n")
+	expected = `table users: SELECT t0."id", t0."name", t1."id", t1."author" FROM "users" t0 LEFT JOIN "posts" t1 ON t1."author" = t0."id";`
+	if proof := db.ProofString(db.L("authored", "Loki", 13)); !strings.Contains(proof, expected) {
+		t.Errorf("Expected proof to contain %v, got %v", expected, proof)
+	}
+	if queries != 0 {
+		t.Errorf("Expected joins to replace calls to each relation, got %v", queries)
+	}
+}
+
+func TestSQLQueryForJoin(t *testing.T) {
+	db := NewDatabase()
+	users := &sqlTable{spec: SQLExternalRelationSpec{Table: "users", Columns: []string{"id", "name"}, Types: []interface{}{0, ""}, Dialect: SQLDialectMySQL}}
+	posts := &sqlTable{spec: SQLExternalRelationSpec{Table: "posts", Columns: []string{"id", "author"}, Types: []interface{}{0, 0}, Dialect: SQLDialectMySQL}}
+
+	// Positional placeholders take their arguments in the order they appear in the query
+	q, args, err := sqlQueryForJoin(db, []*sqlTable{users, posts}, []Literal{
+		db.L("users", V("U"), "Flo"),
+		db.L("posts", 11, V("U")),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "SELECT t0.`id`, t0.`name`, t1.`id`, t1.`author` FROM `users` t0 LEFT JOIN `posts` t1 ON t1.`id` = ? AND t1.`author` = t0.`id` WHERE t0.`name` = ?;"
+	if q != expected {
+		t.Errorf("Expected %v, got %v", expected, q)
+	}
+	if len(args) != 2 || args[0] != "11" || args[1] != "Flo" {
+		t.Errorf("Expected arguments 11 and Flo, got %v", args)
+	}
+}
+
+func TestSQLJoinNulls(t *testing.T) {
+	sqlDB := openTestDB(t)
+	_, err := sqlDB.Exec(`
+	CREATE TABLE posts (
+		id integer,
+		author integer,
+		title text
+	);
+	INSERT INTO posts (id, author, title) VALUES
+	(11, 3, NULL),
+	(12, 3, 'Hi'),
+	(13, 1, NULL),
+	(14, 9, 'Lost');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A NULL in a matched row is a value like any other, and must not hide the row, whichever
+	// side of the join it is on. Without pushdown, each relation is called on its own.
+	newDB := func(pushdown bool) *Database {
+		db := NewDatabase()
+		for _, spec := range []SQLExternalRelationSpec{
+			{Table: "users", Columns: []string{"id", "name"}, Types: []interface{}{0, ""}, Numbers: true},
+			{Table: "posts", Columns: []string{"id", "author", "title"}, Types: []interface{}{0, 0, sql.NullString{}}, Numbers: true},
+		} {
+			relation, err := CreateSQLExternalRelation(spec, sqlDB)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !pushdown {
+				relation.table = nil
+			}
+			db.AddExternalRelations(relation)
+		}
+		cmds, err := db.Parse(strings.NewReader(`
+		titled(Name, Title) :- users(U, Name), posts(P, U, Title).
+		byTitle(Title, Name) :- posts(P, U, Title), users(U, Name).
+		`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range cmds {
+			_, err = db.Apply(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return db
+	}
+
+	for _, query := range []string{"titled(Name, Title)?", "byTitle(Title, Name)?"} {
+		results := []string{}
+		for _, pushdown := range []bool{true, false} {
+			db := newDB(pushdown)
+			answers, err := db.Apply(db.ParseCommandOrPanic(query))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(answers) != 3 {
+				t.Errorf("Expected 3 answers to %v with pushdown %v, got %v", query, pushdown, db.ToString(answers))
+			}
+			results = append(results, db.ToString(answers))
+		}
+		compareDatalogResult(t, results[0], results[1])
+	}
+}
@@ -3,13 +3,93 @@ package authalog
 import (
 	"fmt"
 	"sort"
+	"strings"
+
+	uuid "github.com/satori/go.uuid"
 )
 
+// StaticError is a problem found in a clause before it is run.
+type StaticError struct {
+	// The position of the offending clause, if it was parsed.
+	Pos Position
+	Msg string
+}
+
+func (e *StaticError) Error() string {
+	if e.Pos.IsValid() {
+		return fmt.Sprintf("%v: %v", e.Pos, e.Msg)
+	}
+	return e.Msg
+}
+
+func (c Clause) errorf(format string, args ...interface{}) *StaticError {
+	return &StaticError{Pos: c.Span.Start, Msg: fmt.Sprintf(format, args...)}
+}
+
+// checkAndSchedule checks c, and returns it with its body scheduled by preprocess.
+func (db *Database) checkAndSchedule(c Clause) (Clause, error) {
+	db.clauseMutex.RLock()
+	defer db.clauseMutex.RUnlock()
+	err := db.checkClause(c)
+	if err != nil {
+		return Clause{}, err
+	}
+	return db.preprocess(c), nil
+}
+
+// checkAndScheduleConjunction is like checkAndSchedule, but for the clause that a conjunctive
+// query is solved as, whose head uses the reserved conjunctionPredicate.
+func (db *Database) checkAndScheduleConjunction(c Clause) (Clause, error) {
+	db.clauseMutex.RLock()
+	defer db.clauseMutex.RUnlock()
+	err := db.checkBody(c)
+	if err != nil {
+		return Clause{}, err
+	}
+	return db.preprocess(c), nil
+}
+
+// scheduleForRetract returns c with its body scheduled by preprocess, as the stored clause that
+// c retracts would have been, after checking only c's head. A stored rule whose body can no
+// longer be evaluated, as when a relation it calls has since declared modes, can still be
+// retracted.
+func (db *Database) scheduleForRetract(c Clause) (Clause, error) {
+	db.clauseMutex.RLock()
+	defer db.clauseMutex.RUnlock()
+	err := checkHead(c)
+	if err != nil {
+		return Clause{}, err
+	}
+	return db.preprocess(c), nil
+}
+
+// must be called while holding clauseMutex
 func (db *Database) checkClause(c Clause) error {
+	err := checkHead(c)
+	if err != nil {
+		return err
+	}
+	return db.checkBody(c)
+}
+
+// checkHead checks that c's head is one that clauses may define.
+func checkHead(c Clause) error {
 	if c.Head.Negated {
-		return fmt.Errorf("Clause heads cannot be negated")
+		return c.errorf("Clause heads cannot be negated")
+	}
+	if isComparison(c.Head) || isArithmetic(c.Head) {
+		return c.errorf("%v/%v is built in, and cannot be defined or retracted by clauses", c.Head.Predicate, len(c.Head.Terms))
 	}
+	if c.Head.Predicate == conjunctionPredicate {
+		return c.errorf("%v is reserved for the heads of conjunctive queries, and cannot be defined or retracted by clauses", conjunctionPredicate)
+	}
+	return nil
+}
 
+// checkBody checks that every variable of c is bound where it must be, and that each literal
+// of c's body can be evaluated. Unlike checkClause, it accepts any head.
+// must be called while holding clauseMutex
+func (db *Database) checkBody(c Clause) error {
 	// Check if all variables in the head are bound in the body
 	headVariables := map[int64]struct{}{}
 	bodyPositiveVariables := map[int64]struct{}{}
@@ -39,7 +119,7 @@ func (db *Database) checkClause(c Clause) error {
 		if _, ok := bodyPositiveVariables[k]; ok {
 			continue
 		}
-		return fmt.Errorf("variable \"%v\" bound in clause head, but not in body. All variables in clause heads must also be bound in their bodies", db.termString(Term{Value: k}))
+		return c.errorf("variable \"%v\" bound in clause head, but not in body. All variables in clause heads must also be bound in their bodies", db.termString(Term{Value: k}))
 	}
 
 	// Make sure all variables in negated literals are bound in positive ones.
@@ -47,12 +127,200 @@ func (db *Database) checkClause(c Clause) error {
 		if _, ok := bodyPositiveVariables[k]; ok {
 			continue
 		}
-		return fmt.Errorf("variable '%v' bound in negated literal, not bound in positive literal. All variables bound in a negated literal must also be bound in a positive one", db.termString(Term{Value: k}))
+		return c.errorf("variable '%v' bound in negated literal, not bound in positive literal. All variables bound in a negated literal must also be bound in a positive one", db.termString(Term{Value: k}))
+	}
+
+	for _, l := range c.Body {
+		if !l.isAggregate() {
+			continue
+		}
+		over := l.aggregated()
+		if l.Negated {
+			return c.errorf("aggregate %v cannot be negated", db.literalString(l))
+		}
+		if t := l.Terms[1]; !t.IsConstant && !containsTerm(over.Terms, t) {
+			return c.errorf("aggregated variable '%v' does not appear in %v", db.termString(t), db.literalString(over))
+		}
+		if t := l.Terms[0]; !t.IsConstant && containsTerm(over.Terms, t) {
+			return c.errorf("the result of %v, '%v', cannot also appear in %v", l.Aggregate, db.termString(t), db.literalString(over))
+		}
+	}
+
+	// Built in relations, aggregates and external relations with modes can only be evaluated
+	// once their inputs are bound, so each of their input variables must be bound by an ordinary
+	// positive literal, or by one of these literals whose own inputs are bound.
+	boundVariables := map[int64]struct{}{}
+	for i, l := range c.Body {
+		if _, ok := db.builtinInputs(c, i); l.Negated || ok {
+			continue
+		}
+		for _, t := range l.Terms {
+			if !t.IsConstant {
+				boundVariables[t.Value] = struct{}{}
+			}
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		for i, l := range c.Body {
+			inputs, ok := db.builtinInputs(c, i)
+			if !ok || l.Negated || !anyBound(inputs, boundVariables) {
+				continue
+			}
+			for _, output := range builtinOutputs(l) {
+				if _, ok := boundVariables[output.Value]; !output.IsConstant && !ok {
+					boundVariables[output.Value] = struct{}{}
+					changed = true
+				}
+			}
+		}
+	}
+	for i, l := range c.Body {
+		inputs, ok := db.builtinInputs(c, i)
+		if !ok || anyBound(inputs, boundVariables) {
+			if l.isAggregate() {
+				if err := db.checkModes(c, l.aggregated(), boundVariables); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if !isBuiltin(l) {
+			return db.checkModes(c, l, boundVariables)
+		}
+		for _, t := range inputs[0] {
+			if _, ok := boundVariables[t.Value]; !t.IsConstant && !ok {
+				if l.isAggregate() {
+					return c.errorf("variable '%v' in %v is not bound in a positive literal. Variables that an aggregate shares with the rest of its rule group its answers, and must be bound before it is evaluated", db.termString(t), db.literalString(l))
+				}
+				return c.errorf("variable '%v' in %v is not bound in a positive literal. Built in relations like %v/%v can only be evaluated once their inputs are bound", db.termString(t), db.literalString(l), l.Predicate, len(l.Terms))
+			}
+		}
 	}
 	return nil
 }
 
-func preprocess(c Clause) Clause {
+// checkModes returns an error if l's predicate is provided by external relations that declare
+// modes, and none of them is satisfied once the variables in bound are bound.
+func (db *Database) checkModes(c Clause, l Literal, bound map[int64]struct{}) error {
+	modes := db.modes(l)
+	if len(modes) == 0 {
+		return nil
+	}
+	call := callMode(l.Terms, bound)
+	for _, m := range modes {
+		if modeSatisfied(call, m) {
+			return nil
+		}
+	}
+	return c.errorf("%v would be called as %v, but %v/%v can only be called as %v", db.literalString(l), modeString(l.Predicate, call), l.Predicate, len(l.Terms), modeStrings(l.Predicate, modes))
+}
+
+// modes returns the modes declared by the external relations that provide l's predicate.
+// must be called while holding clauseMutex
+func (db *Database) modes(l Literal) []string {
+	modes := []string{}
+	for _, r := range db.externalRelationsFor(l) {
+		modes = append(modes, r.modes...)
+	}
+	return modes
+}
+
+func isBuiltin(l Literal) bool {
+	return isComparison(l) || isArithmetic(l) || l.isAggregate()
+}
+
+// builtinInputs returns the terms of c.Body[i] that must be bound before it can be evaluated,
+// as alternatives of which any one will do: every argument of a comparison, the operands of
+// an arithmetic literal, the variables that an aggregate shares with the rest of c, and the
+// '+' arguments of each mode of an external relation that declares them. It returns false for
+// literals that can be evaluated however their arguments are bound.
+func (db *Database) builtinInputs(c Clause, i int) ([][]Term, bool) {
+	l := c.Body[i]
+	switch {
+	case isComparison(l):
+		return [][]Term{l.Terms}, true
+	case isArithmetic(l):
+		return [][]Term{l.Terms[:2]}, true
+	case l.isAggregate():
+		return [][]Term{aggregateInputs(c, i)}, true
+	}
+	modes := db.modes(l)
+	if len(modes) == 0 {
+		return nil, false
+	}
+	inputs := make([][]Term, len(modes))
+	for j, m := range modes {
+		for k, t := range l.Terms {
+			if m[k] == '+' {
+				inputs[j] = append(inputs[j], t)
+			}
+		}
+	}
+	return inputs, true
+}
+
+// builtinOutputs returns the terms that evaluating a literal with inputs binds.
+func builtinOutputs(l Literal) []Term {
+	switch {
+	case isComparison(l):
+		return nil
+	case isArithmetic(l):
+		return l.Terms[2:]
+	case l.isAggregate():
+		return l.Terms[:1]
+	}
+	return l.Terms
+}
+
+// aggregateInputs returns the variables of the aggregated literal of c.Body[i] that also
+// appear elsewhere in c. They group the aggregate's answers; its other variables are local
+// to it.
+func aggregateInputs(c Clause, i int) []Term {
+	elsewhere := append([]Term{}, c.Head.Terms...)
+	for j, l := range c.Body {
+		if j != i {
+			elsewhere = append(elsewhere, l.Terms...)
+		}
+	}
+	inputs := []Term{}
+	for _, t := range c.Body[i].aggregated().Terms {
+		if !t.IsConstant && containsTerm(elsewhere, t) && !containsTerm(inputs, t) {
+			inputs = append(inputs, t)
+		}
+	}
+	return inputs
+}
+
+func containsTerm(terms []Term, t Term) bool {
+	for _, o := range terms {
+		if o == t {
+			return true
+		}
+	}
+	return false
+}
+
+func allBound(terms []Term, bound map[int64]struct{}) bool {
+	for _, t := range terms {
+		if _, ok := bound[t.Value]; !t.IsConstant && !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func anyBound(alternatives [][]Term, bound map[int64]struct{}) bool {
+	for _, terms := range alternatives {
+		if allBound(terms, bound) {
+			return true
+		}
+	}
+	return false
+}
+
+// must be called while holding clauseMutex
+func (db *Database) preprocess(c Clause) Clause {
 	if len(c.Body) == 0 {
 		return c
 	}
@@ -60,6 +328,7 @@ func preprocess(c Clause) Clause {
 	n := Clause{
 		Head: c.Head,
 		Body: make([]Literal, len(c.Body)),
+		Span: c.Span,
 	}
 	for i, l := range c.Body {
 		n.Body[i] = l
@@ -72,5 +341,360 @@ func preprocess(c Clause) Clause {
 		}
 		return false
 	})
+	n.Body = db.scheduleBuiltins(n)
 	return n
 }
+
+// scheduleBuiltins moves each positive built in, aggregate, and call to an external relation
+// with modes in c's body to just after the first literals that bind its inputs, so that it is
+// evaluated as early as it can be.
+func (db *Database) scheduleBuiltins(c Clause) []Literal {
+	scheduled := make([]Literal, 0, len(c.Body))
+	bound := map[int64]struct{}{}
+	bind := func(terms ...Term) {
+		for _, t := range terms {
+			if !t.IsConstant {
+				bound[t.Value] = struct{}{}
+			}
+		}
+	}
+
+	pending := []int{}
+	for i, l := range c.Body {
+		if _, ok := db.builtinInputs(c, i); ok && !l.Negated {
+			pending = append(pending, i)
+		} else {
+			scheduled = append(scheduled, l)
+			if !l.Negated {
+				bind(l.Terms...)
+			}
+		}
+		// Evaluating a built in may bind its output, which may ready others
+		for progress := true; progress; {
+			progress = false
+			waiting := []int{}
+			for _, p := range pending {
+				if inputs, _ := db.builtinInputs(c, p); anyBound(inputs, bound) {
+					scheduled = append(scheduled, c.Body[p])
+					bind(builtinOutputs(c.Body[p])...)
+					progress = true
+				} else {
+					waiting = append(waiting, p)
+				}
+			}
+			pending = waiting
+		}
+	}
+	// Built ins whose inputs are never bound fail when evaluated
+	for _, p := range pending {
+		scheduled = append(scheduled, c.Body[p])
+	}
+	return scheduled
+}
+
+// rescheduleCalls schedules the bodies of stored rules that call any of predicates again, as
+// the modes they are called with may have changed since the rules were asserted. It returns
+// the heads of the rules whose bodies were reordered.
+// must be called while holding clauseMutex
+func (db *Database) rescheduleCalls(predicates map[indexKey]struct{}) []Literal {
+	ids := []uuid.UUID{}
+	for id, c := range db.clauses {
+		for _, l := range c.Body {
+			if l.isAggregate() {
+				l = l.aggregated()
+			}
+			if _, ok := predicates[predicateKey(l)]; ok {
+				ids = append(ids, id)
+				break
+			}
+		}
+	}
+
+	heads := []Literal{}
+	for _, id := range ids {
+		c := db.clauses[id]
+		scheduled := db.preprocess(c)
+		if scheduled.tag() == c.tag() {
+			continue
+		}
+		db.deleteClause(id)
+		db.storeClause(scheduled.id(), scheduled)
+		heads = append(heads, scheduled.Head)
+	}
+	return heads
+}
+
+// dependency counts the rule body literals through which one predicate depends on another.
+type dependency struct {
+	positive int
+	negative int
+}
+
+// addDependencies records the predicate dependencies introduced by c's body, unless doing so
+// would place a negated or aggregate literal on a recursive cycle. Such programs are not
+// stratified, and their answers would depend on the order of search.
+// must be called while holding clauseMutex
+func (db *Database) addDependencies(c Clause) error {
+	head := c.Head.Predicate
+	for _, l := range c.Body {
+		if _, ok := db.dependencies[head]; !ok {
+			db.dependencies[head] = map[string]*dependency{}
+		}
+		d, ok := db.dependencies[head][l.Predicate]
+		if !ok {
+			d = &dependency{}
+			db.dependencies[head][l.Predicate] = d
+		}
+		if l.Negated || l.isAggregate() {
+			d.negative++
+		} else {
+			d.positive++
+		}
+	}
+
+	for _, l := range c.Body {
+		if cycle := db.negativeCycle(head, l); cycle != nil {
+			db.removeDependencies(c)
+			if l.isAggregate() {
+				return c.errorf("aggregation inside recursion: %v depends on itself through an aggregate (%v)", head, strings.Join(cycle, " -> "))
+			}
+			return c.errorf("negation inside recursion: %v depends on itself through a negated literal (%v)", head, strings.Join(cycle, " -> "))
+		}
+	}
+	return nil
+}
+
+// must be called while holding clauseMutex
+func (db *Database) removeDependencies(c Clause) {
+	head := c.Head.Predicate
+	for _, l := range c.Body {
+		d, ok := db.dependencies[head][l.Predicate]
+		if !ok {
+			continue
+		}
+		if l.Negated || l.isAggregate() {
+			d.negative--
+		} else {
+			d.positive--
+		}
+		if d.positive == 0 && d.negative == 0 {
+			delete(db.dependencies[head], l.Predicate)
+		}
+	}
+	if len(db.dependencies[head]) == 0 {
+		delete(db.dependencies, head)
+	}
+}
+
+// negativeCycle looks for a path from the predicate of l, a body literal in a rule for head, back
+// to head, that passes through at least one negated or aggregate literal. If there is one, the
+// predicates along it are returned, starting and ending with head.
+func (db *Database) negativeCycle(head string, l Literal) []string {
+	type step struct {
+		predicate string
+		negated   bool
+	}
+	start := step{l.Predicate, l.Negated || l.isAggregate()}
+	parents := map[step]step{start: start}
+	queue := []step{start}
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+		if s.predicate == head && s.negated {
+			cycle := []string{}
+			for ; s != start; s = parents[s] {
+				cycle = append([]string{s.predicate}, cycle...)
+			}
+			return append([]string{head, start.predicate}, cycle...)
+		}
+		for next, d := range db.dependencies[s.predicate] {
+			if d.positive > 0 {
+				n := step{next, s.negated}
+				if _, ok := parents[n]; !ok {
+					parents[n] = s
+					queue = append(queue, n)
+				}
+			}
+			if d.negative > 0 {
+				n := step{next, true}
+				if _, ok := parents[n]; !ok {
+					parents[n] = s
+					queue = append(queue, n)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// SetCheckOnAssert controls whether Assert rejects clauses that define or call a predicate with
+// a different number of arguments than its existing definitions. Calls to predicates that are
+// not yet defined are allowed, as they may be defined later; use Check once a program is
+// fully loaded to find them.
+func (db *Database) SetCheckOnAssert(enabled bool) {
+	db.clauseMutex.Lock()
+	defer db.clauseMutex.Unlock()
+	db.checkOnAssert = enabled
+}
+
+// Check walks every clause in the database, and reports calls to predicates that are not
+// defined by any clause or external relation, along with definitions and calls whose number
+// of arguments disagrees with the predicate's definitions, and rules that no order can call
+// their external relations' modes from.
+func (db *Database) Check() []error {
+	db.clauseMutex.RLock()
+	defer db.clauseMutex.RUnlock()
+
+	seen := map[string]struct{}{}
+	errs := []*StaticError{}
+	report := func(err *StaticError) {
+		if _, ok := seen[err.Error()]; !ok {
+			seen[err.Error()] = struct{}{}
+			errs = append(errs, err)
+		}
+	}
+
+	predicates := map[string]struct{}{}
+	for p := range db.definitions {
+		predicates[p] = struct{}{}
+	}
+	for k := range db.externalRelations {
+		predicates[k.predicate] = struct{}{}
+	}
+	for p := range predicates {
+		if arities := db.arities(p); len(arities) > 1 {
+			report(&StaticError{Pos: db.definitionPos(p), Msg: fmt.Sprintf("%v is defined with different numbers of arguments: %v", p, arityList(arities))})
+		}
+	}
+
+	for _, c := range db.clauses {
+		for _, err := range db.checkArities(c, true) {
+			report(err)
+		}
+		// Rules asserted before the relations they call declared modes were not checked
+		// against them
+		if err := db.checkClause(c); err != nil {
+			if se, ok := err.(*StaticError); ok {
+				report(se)
+			} else {
+				report(&StaticError{Pos: c.Span.Start, Msg: err.Error()})
+			}
+		}
+	}
+
+	sort.Slice(errs, func(i, j int) bool {
+		a, b := errs[i].Pos, errs[j].Pos
+		if a != b {
+			return positionBefore(a, b)
+		}
+		return errs[i].Msg < errs[j].Msg
+	})
+	ret := make([]error, len(errs))
+	for i, err := range errs {
+		ret[i] = err
+	}
+	return ret
+}
+
+// checkArities checks c's head and body literals against the arities that their predicates
+// are defined with. If requireDefined is set, calls to undefined predicates are reported too.
+// must be called while holding clauseMutex
+func (db *Database) checkArities(c Clause, requireDefined bool) []*StaticError {
+	errs := []*StaticError{}
+	if arities := db.arities(c.Head.Predicate); len(arities) > 0 {
+		if _, ok := arities[len(c.Head.Terms)]; !ok {
+			errs = append(errs, c.errorf("%v/%v is defined with %v arguments", c.Head.Predicate, len(c.Head.Terms), arityList(arities)))
+		}
+	}
+	for _, l := range c.Body {
+		if l.isAggregate() {
+			l = l.aggregated()
+		}
+		arities := db.arities(l.Predicate)
+		if len(arities) == 0 {
+			if requireDefined {
+				errs = append(errs, c.errorf("in a rule for %v/%v: %v/%v is not defined by any clause or external relation", c.Head.Predicate, len(c.Head.Terms), l.Predicate, len(l.Terms)))
+			}
+			continue
+		}
+		if _, ok := arities[len(l.Terms)]; !ok {
+			errs = append(errs, c.errorf("in a rule for %v/%v: %v called with %v arguments, but is defined with %v", c.Head.Predicate, len(c.Head.Terms), l.Predicate, len(l.Terms), arityList(arities)))
+		}
+	}
+	return errs
+}
+
+// arities returns the numbers of arguments that a predicate is defined with, by clauses and
+// external relations.
+// must be called while holding clauseMutex
+func (db *Database) arities(predicate string) map[int]struct{} {
+	arities := map[int]struct{}{}
+	for a := range db.definitions[predicate] {
+		arities[a] = struct{}{}
+	}
+	for k := range db.externalRelations {
+		if k.predicate == predicate {
+			arities[k.arity] = struct{}{}
+		}
+	}
+	return arities
+}
+
+// definitionPos returns the earliest position of the parsed clauses defining a predicate, or
+// an invalid position if none were parsed.
+// must be called while holding clauseMutex
+func (db *Database) definitionPos(predicate string) Position {
+	pos := Position{}
+	for arity := range db.definitions[predicate] {
+		for id := range db.index[indexKey{predicate: predicate, arity: arity, position: -1}] {
+			p := db.clauses[id].Span.Start
+			if p.IsValid() && (!pos.IsValid() || positionBefore(p, pos)) {
+				pos = p
+			}
+		}
+	}
+	return pos
+}
+
+func positionBefore(a, b Position) bool {
+	if a.Filename != b.Filename {
+		return a.Filename < b.Filename
+	}
+	if a.Line != b.Line {
+		return a.Line < b.Line
+	}
+	return a.Column < b.Column
+}
+
+func arityList(arities map[int]struct{}) string {
+	as := []int{}
+	for a := range arities {
+		as = append(as, a)
+	}
+	sort.Ints(as)
+	strs := make([]string, len(as))
+	for i, a := range as {
+		strs[i] = fmt.Sprint(a)
+	}
+	return strings.Join(strs, " or ")
+}
+
+// must be called while holding clauseMutex
+func (db *Database) addDefinition(head Literal) {
+	if _, ok := db.definitions[head.Predicate]; !ok {
+		db.definitions[head.Predicate] = map[int]int{}
+	}
+	db.definitions[head.Predicate][len(head.Terms)]++
+}
+
+// must be called while holding clauseMutex
+func (db *Database) removeDefinition(head Literal) {
+	arity := len(head.Terms)
+	db.definitions[head.Predicate][arity]--
+	if db.definitions[head.Predicate][arity] <= 0 {
+		delete(db.definitions[head.Predicate], arity)
+	}
+	if len(db.definitions[head.Predicate]) == 0 {
+		delete(db.definitions, head.Predicate)
+	}
+}
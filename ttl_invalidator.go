@@ -1,6 +1,7 @@
 package authalog
 
 import (
+	"context"
 	"sync"
 	"time"
 )
@@ -78,10 +79,12 @@ func (ttl *TTLInvalidator) Start() {
 
 func (ttl *TTLInvalidator) InvalidatingRelation(er ExternalRelation) ExternalRelation {
 	new := ExternalRelation{
-		head: er.head,
+		head:     er.head,
+		describe: er.describe,
+		modes:    er.modes,
 	}
-	new.run = func(i interner, terms []Term) ([][]Term, error) {
-		r, err := er.run(i, terms)
+	new.run = func(ctx context.Context, i interner, terms []Term) ([][]Term, error) {
+		r, err := er.run(ctx, i, terms)
 		// TODO: do we want to store an invalidation on error?
 		ttl.requests <- ttlAlive{
 			l:     Literal{Predicate: new.head.Predicate, Terms: terms},
@@ -89,5 +92,17 @@ func (ttl *TTLInvalidator) InvalidatingRelation(er ExternalRelation) ExternalRel
 		}
 		return r, err
 	}
+	if er.batch != nil {
+		new.batch = func(ctx context.Context, i interner, calls [][]Term) ([][][]Term, error) {
+			r, err := er.batch(ctx, i, calls)
+			for _, terms := range calls {
+				ttl.requests <- ttlAlive{
+					l:     Literal{Predicate: new.head.Predicate, Terms: terms},
+					alive: time.Now().UnixNano(),
+				}
+			}
+			return r, err
+		}
+	}
 	return new
 }
@@ -0,0 +1,262 @@
+package authalog
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Explanation describes why a literal could not be proven.
+type Explanation struct {
+	// The literal that could not be proven.
+	Literal Literal
+	// External is set if Literal's predicate is provided by an external relation, which
+	// returned no matching tuples.
+	External bool
+	// Candidates describes each rule whose head unifies with Literal.
+	Candidates []Candidate
+
+	db *Database
+}
+
+// Candidate describes why a single rule failed to prove a literal.
+type Candidate struct {
+	// The rule, with the bindings made by unifying its head with the explained literal and by
+	// the body literals before the failing one.
+	Clause Clause
+	// The index in Clause.Body of the first literal that could not be satisfied.
+	FailedAt int
+	// Blockers is set when the failing literal is negated, and lists the answers to its
+	// positive form that prevented the rule from succeeding.
+	Blockers []Literal
+	// Because explains why a failing positive literal could not be proven. It is nil for
+	// negated and aggregate literals, and for literals explained elsewhere in the tree.
+	Because *Explanation
+}
+
+// Failed returns the first body literal that could not be satisfied.
+func (c Candidate) Failed() Literal {
+	return c.Clause.Body[c.FailedAt]
+}
+
+// WhyNot explains why l has no answers. For each rule that could have proven l, it finds the
+// first body literal that could not be satisfied: either a positive literal with no answers,
+// which is explained in turn, or a negated literal whose positive form holds.
+func (db *Database) WhyNot(l Literal) (*Explanation, error) {
+	return db.WhyNotContext(context.Background(), l)
+}
+
+// WhyNotContext is like WhyNot, but abandons the search with ctx.Err() once ctx is done.
+func (db *Database) WhyNotContext(ctx context.Context, l Literal) (*Explanation, error) {
+	results, err := db.ask(ctx, l)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) > 0 {
+		return nil, fmt.Errorf("%v has %v answers", db.literalString(l), len(results))
+	}
+	return db.explain(ctx, l, map[uuid.UUID]struct{}{})
+}
+
+func (db *Database) explain(ctx context.Context, l Literal, seen map[uuid.UUID]struct{}) (*Explanation, error) {
+	seen[subgoalHash(l)] = struct{}{}
+	e := &Explanation{
+		Literal: l,
+		db:      db,
+	}
+
+	rules := []Clause{}
+	db.clauseMutex.RLock()
+	for _, r := range db.externalRelationsFor(l) {
+		if unifiesApart(l, r.head) {
+			e.External = true
+		}
+	}
+	for _, id := range db.index.candidates(l) {
+		c := db.clauses[id]
+		// Any fact that unifies would have been an answer
+		if len(c.Body) > 0 && unifiesApart(l, c.Head) {
+			rules = append(rules, c)
+		}
+	}
+	db.clauseMutex.RUnlock()
+
+	sort.Slice(rules, func(i, j int) bool {
+		a, b := rules[i].Span.Start, rules[j].Span.Start
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		if a.Column != b.Column {
+			return a.Column < b.Column
+		}
+		return rules[i].String() < rules[j].String()
+	})
+
+	for _, r := range rules {
+		c, err := db.explainRule(ctx, l, r, seen)
+		if err != nil {
+			return nil, err
+		}
+		e.Candidates = append(e.Candidates, c)
+	}
+	return e, nil
+}
+
+// explainRule walks the body of rule r, keeping every set of bindings that satisfies the body
+// so far, until one of the body's literals eliminates them all.
+func (db *Database) explainRule(ctx context.Context, l Literal, r Clause, seen map[uuid.UUID]struct{}) (Candidate, error) {
+	r = db.renamedApart(r)
+	env := emptyEnvironment()
+	if !unify(l, r.Head, &env) {
+		return Candidate{}, fmt.Errorf("%v does not unify with %v", l, r.Head)
+	}
+	states := []Clause{resolved(env, r)}
+
+	for i := range r.Body {
+		next := []Clause{}
+		blockers := map[uuid.UUID]Literal{}
+		for _, s := range states {
+			if s.Body[i].isAggregate() {
+				env, ok, err := db.evaluateAggregate(ctx, s.Body[i])
+				if err != nil {
+					return Candidate{}, err
+				}
+				if ok {
+					next = append(next, resolved(env, s))
+				}
+				continue
+			}
+			target := s.Body[i]
+			target.Negated = false
+			results, err := db.ask(ctx, target)
+			if err != nil {
+				return Candidate{}, err
+			}
+			if s.Body[i].Negated {
+				if len(results) == 0 {
+					next = append(next, s)
+				}
+				for _, res := range results {
+					blockers[res.Literal.id()] = res.Literal
+				}
+				continue
+			}
+			// Keep the order of bindings stable, so that explanations are too
+			sort.Slice(results, func(i, j int) bool {
+				return db.literalString(results[i].Literal) < db.literalString(results[j].Literal)
+			})
+			for _, res := range results {
+				env := emptyEnvironment()
+				if unify(target, res.Literal, &env) {
+					next = append(next, resolved(env, s))
+				}
+			}
+		}
+
+		if len(next) > 0 {
+			states = next
+			continue
+		}
+
+		c := Candidate{
+			Clause:   states[0],
+			FailedAt: i,
+		}
+		failed := c.Failed()
+		if failed.Negated {
+			for _, b := range blockers {
+				c.Blockers = append(c.Blockers, b)
+			}
+			sort.Slice(c.Blockers, func(i, j int) bool {
+				return db.literalString(c.Blockers[i]) < db.literalString(c.Blockers[j])
+			})
+		} else if _, ok := seen[subgoalHash(failed)]; !ok && !failed.isAggregate() {
+			because, err := db.explain(ctx, failed, seen)
+			if err != nil {
+				return Candidate{}, err
+			}
+			c.Because = because
+		}
+		return c, nil
+	}
+	return Candidate{}, fmt.Errorf("rule %v proves %v, which should have had no answers", db.literalString(r.Head), db.literalString(l))
+}
+
+// renamedApart returns a copy of c with fresh variables, so that they can collide with neither
+// the variables of queries nor those introduced while searching. Like asserted clauses, it
+// draws them from db.vars, rather than interning names that would outlive the explanation.
+func (db *Database) renamedApart(c Clause) Clause {
+	db.internMutex.Lock()
+	defer db.internMutex.Unlock()
+
+	fresh, _ := freshen(c, &db.vars)
+	return fresh
+}
+
+// resolved rewrites c with env until every variable bound in env has been replaced, following
+// chains of variable to variable bindings.
+func resolved(env environment, c Clause) Clause {
+	for i := 0; i <= env.count; i++ {
+		c = env.rewriteClause(c)
+	}
+	return c
+}
+
+func (db *Database) literalString(l Literal) string {
+	var buf bytes.Buffer
+	db.writeLiteral(&buf, &l)
+	return buf.String()
+}
+
+func (e *Explanation) String() string {
+	var buf bytes.Buffer
+	e.write(&buf, 0)
+	return buf.String()
+}
+
+func (e *Explanation) write(w io.Writer, depth int) {
+	indent := strings.Repeat("  ", depth)
+	db := e.db
+	fmt.Fprintf(w, "%v%v could not be proven", indent, db.literalString(e.Literal))
+	switch {
+	case len(e.Candidates) > 0:
+		fmt.Fprintf(w, ":\n")
+	case e.External:
+		fmt.Fprintf(w, ": its external relation returned no matching tuples\n")
+	default:
+		fmt.Fprintf(w, ": no facts or rules match\n")
+	}
+
+	for _, c := range e.Candidates {
+		body := make([]string, len(c.Clause.Body))
+		for i, l := range c.Clause.Body {
+			body[i] = db.literalString(l)
+		}
+		fmt.Fprintf(w, "%v  %v :- %v.", indent, db.literalString(c.Clause.Head), strings.Join(body, ", "))
+		if c.Clause.Span.Start.IsValid() {
+			fmt.Fprintf(w, " %% %v", c.Clause.Span.Start)
+		}
+		fmt.Fprintf(w, "\n")
+
+		failed := c.Failed()
+		if failed.Negated {
+			blockers := make([]string, len(c.Blockers))
+			for i, b := range c.Blockers {
+				blockers[i] = db.literalString(b)
+			}
+			fmt.Fprintf(w, "%v    blocked at %v, because %v holds\n", indent, db.literalString(failed), strings.Join(blockers, ", "))
+		} else if c.Because != nil {
+			fmt.Fprintf(w, "%v    failed at %v\n", indent, db.literalString(failed))
+			c.Because.write(w, depth+3)
+		} else if failed.isAggregate() {
+			fmt.Fprintf(w, "%v    failed at %v\n", indent, db.literalString(failed))
+		} else {
+			fmt.Fprintf(w, "%v    failed at %v, explained above\n", indent, db.literalString(failed))
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package authalog
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWhyNot(t *testing.T) {
+	db := NewDatabase()
+	db.AddExternalRelations(testRelation)
+	cmds, err := db.ParseFile("policy.dl", strings.NewReader(`foo(a). foo(b). bar(a). qux(c).
+baz(X) :- foo(X), !bar(X).
+baz(X) :- qux(X), external(X, d).
+baz(X) :- quux(X, Y).
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cmds {
+		_, err = db.Apply(c)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Literals without answers have no proof to write
+	noProof := "% No proof of baz(a) has been recorded. Ask for it first, or see WhyNot.\n"
+	if proof := db.ProofString(db.L("baz", "a")); proof != noProof {
+		t.Errorf("Expected %v, got %v", noProof, proof)
+	}
+
+	e, err := db.WhyNot(db.L("baz", "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.Candidates) != 3 {
+		t.Fatal("Expected 3 candidates, got", len(e.Candidates))
+	}
+	blocked := e.Candidates[0]
+	if blocked.FailedAt != 1 || len(blocked.Blockers) != 1 || db.literalString(blocked.Blockers[0]) != "bar(a)" {
+		t.Errorf("Expected baz(a) to be blocked by bar(a), got %+v", blocked)
+	}
+	failed := e.Candidates[1]
+	if failed.FailedAt != 0 || failed.Because == nil || len(failed.Because.Candidates) != 0 {
+		t.Errorf("Expected baz(a) to fail at qux(a), got %+v", failed)
+	}
+
+	expected := `baz(a) could not be proven:
+  baz(a) :- foo(a), !bar(a). % policy.dl:2:1
+    blocked at !bar(a), because bar(a) holds
+  baz(a) :- qux(a), external(a, d). % policy.dl:3:1
+    failed at qux(a)
+      qux(a) could not be proven: no facts or rules match
+  baz(a) :- quux(a, _`
+	if s := e.String(); !strings.HasPrefix(s, expected) || !strings.Contains(s, "quux(a, _") {
+		t.Errorf("Unexpected explanation:\n%v", s)
+	}
+
+	// External relations that return nothing are reported as such
+	e, err = db.WhyNot(db.L("baz", "c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	because := e.Candidates[1].Because
+	if e.Candidates[1].FailedAt != 1 || because == nil || !because.External {
+		t.Errorf("Expected baz(c) to fail at the external relation, got %v", e)
+	}
+
+	_, err = db.WhyNot(db.L("baz", "b"))
+	if err == nil {
+		t.Error("Expected an error explaining a literal with answers")
+	}
+
+	// Explaining renames rules apart without interning anything
+	interned := len(db.internedLookup)
+	for i := 0; i < 10; i++ {
+		_, err = db.WhyNot(db.L("baz", "a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(db.internedLookup) != interned {
+		t.Errorf("Expected WhyNot to intern nothing, but the intern table grew from %v to %v", interned, len(db.internedLookup))
+	}
+}